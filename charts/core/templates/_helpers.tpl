@@ -7,20 +7,27 @@ Expand the name of the chart.
 {{- end -}}
 
 {{/*
-Create a default fully qualified app name.
-We truncate at 63 chars because some Kubernetes name fields are limited to this (by the DNS naming spec).
-If release name contains chart name it will be used as a full name.
+Prefix of the resource names. It stays "neuvector" by default so that upgrades keep the existing names.
+fullnameOverride replaces the prefix, and nameOverride is used as the prefix when fullnameOverride is not set.
+Names that NeuVector looks up at runtime, such as RBAC roles, webhook services, leases, the bootstrap secret
+and the internal certificate secret, are not affected.
 */}}
 {{- define "neuvector.fullname" -}}
 {{- if .Values.fullnameOverride -}}
-{{- .Values.fullnameOverride | trunc 63 | trimSuffix "-" -}}
+{{- .Values.fullnameOverride | trunc 36 | trimSuffix "-" -}}
 {{- else -}}
-{{- $name := default .Chart.Name .Values.nameOverride -}}
-{{- if contains $name .Release.Name -}}
-{{- .Release.Name | trunc 63 | trimSuffix "-" -}}
-{{- else -}}
-{{- printf "%s-%s" .Release.Name $name | trunc 63 | trimSuffix "-" -}}
+{{- default "neuvector" .Values.nameOverride | trunc 36 | trimSuffix "-" -}}
+{{- end -}}
 {{- end -}}
+
+{{/*
+Address used by the NeuVector components to join the controller cluster.
+*/}}
+{{- define "neuvector.controller.joinAddr" -}}
+{{- if .Values.clusterDomain -}}
+{{- printf "%s-svc-controller.%s.svc.%s" (include "neuvector.fullname" .) .Release.Namespace .Values.clusterDomain -}}
+{{- else -}}
+{{- printf "%s-svc-controller.%s" (include "neuvector.fullname" .) .Release.Namespace -}}
 {{- end -}}
 {{- end -}}
 
@@ -32,11 +39,44 @@ Create chart name and version as used by the chart label.
 {{- end -}}
 
 {{/*
-Lookup secret.
+Image pull secret entries. imagePullSecrets is a list of secret names or {name: ...} objects,
+a single string is deprecated.
+*/}}
+{{- define "neuvector.imagePullSecrets" -}}
+{{- $secrets := list -}}
+{{- range (kindIs "string" . | ternary (list .) .) -}}
+{{- if kindIs "string" . -}}
+{{- $secrets = append $secrets (dict "name" .) -}}
+{{- else -}}
+{{- $secrets = append $secrets (dict "name" .name) -}}
+{{- end -}}
+{{- end -}}
+{{- toYaml $secrets -}}
+{{- end -}}
+
+{{/*
+Detect OpenShift. "openshift" can be true, false or auto. With auto, the cluster is treated as
+OpenShift when the route or security API groups are served. Returns "true" or an empty string.
+*/}}
+{{- define "neuvector.openshift" -}}
+{{- if eq (toString .Values.openshift) "auto" -}}
+{{- if or (.Capabilities.APIVersions.Has "route.openshift.io/v1") (.Capabilities.APIVersions.Has "security.openshift.io/v1") -}}
+true
+{{- end -}}
+{{- else if .Values.openshift -}}
+true
+{{- end -}}
+{{- end -}}
+
+{{/*
+Lookup secret. In GitOps mode the cluster is not read and the default value is used.
 */}}
 {{- define "neuvector.secrets.lookup" -}}
 {{- $value := "" -}}
-{{- $secretData := (lookup "v1" "Secret" .namespace .secret).data  -}}
+{{- $secretData := dict -}}
+{{- if not .gitops -}}
+{{- $secretData = (lookup "v1" "Secret" .namespace .secret).data  -}}
+{{- end -}}
 {{- if and $secretData (hasKey $secretData .key) -}}
   {{- $value = index $secretData .key -}}
 {{- else if .defaultValue -}}
@@ -47,6 +87,300 @@ Lookup secret.
 {{- end -}}
 {{- end -}}
 
+{{/*
+Cloud marketplace of the CSP billing adapter, aws, azure or gcp.
+*/}}
+{{- define "neuvector.csp" -}}
+{{- $enabled := list -}}
+{{- range $csp := list "aws" "azure" "gcp" -}}
+{{- if (index $.Values.global $csp | default dict).enabled -}}
+{{- $enabled = append $enabled $csp -}}
+{{- end -}}
+{{- end -}}
+{{- if gt (len $enabled) 1 -}}
+{{- fail (printf "only one of global.aws, global.azure and global.gcp can be enabled, got %s" (join ", " $enabled)) -}}
+{{- end -}}
+{{- first $enabled | default "" -}}
+{{- end -}}
+
+{{- define "neuvector.csp.serviceAccount" -}}
+{{- $csp := include "neuvector.csp" . -}}
+{{- if $csp -}}
+{{- (index .Values.global $csp).serviceAccount -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Service account of a component, one of manager, controller, enforcer, scanner, updater, adapter or
+certupgrader, from its serviceAccount values. The name defaults to serviceAccount, or with
+leastPrivilege to the account of the component.
+*/}}
+{{- define "neuvector.serviceAccount" -}}
+{{- $top := index . 0 -}}
+{{- $component := index . 1 -}}
+{{- $components := dict
+  "manager" (list $top.Values.manager "basic")
+  "controller" (list $top.Values.controller "controller")
+  "enforcer" (list $top.Values.enforcer "enforcer")
+  "scanner" (list $top.Values.cve.scanner "scanner")
+  "updater" (list $top.Values.cve.updater "updater")
+  "adapter" (list $top.Values.cve.adapter "registry-adapter")
+  "certupgrader" (list $top.Values.controller.certupgrader "cert-upgrader") -}}
+{{- $entry := index $components $component -}}
+{{- $sa := (index $entry 0).serviceAccount | default dict -}}
+{{- $name := $top.Values.leastPrivilege | ternary (index $entry 1) $top.Values.serviceAccount -}}
+{{- toYaml (dict
+  "name" ($sa.name | default $name)
+  "create" (ne (toString $sa.create) "false")
+  "annotations" ($sa.annotations | default dict)
+  "labels" ($sa.labels | default dict)
+  "automountServiceAccountToken" $sa.automountServiceAccountToken) -}}
+{{- end -}}
+
+{{- define "neuvector.serviceAccount.name" -}}
+{{- (include "neuvector.serviceAccount" . | fromYaml).name -}}
+{{- end -}}
+
+{{/*
+Distinct service accounts of the components. Without leastPrivilege every account is bound to all
+the roles.
+*/}}
+{{- define "neuvector.serviceAccount.names" -}}
+{{- $names := list -}}
+{{- range $component := list "manager" "controller" "enforcer" "scanner" "updater" "adapter" "certupgrader" -}}
+{{- $names = append $names (include "neuvector.serviceAccount.name" (list $ $component)) -}}
+{{- end -}}
+{{- toJson (uniq $names) -}}
+{{- end -}}
+
+{{/*
+Pod labels of a component, its podLabels value merged with the labels required by its workload
+identity. Azure Workload Identity only injects the token into pods labeled azure.workload.identity/use.
+Takes (list $ component podLabels).
+*/}}
+{{- define "neuvector.serviceAccount.podLabels" -}}
+{{- $labels := deepCopy (index . 2 | default dict) -}}
+{{- $sa := include "neuvector.serviceAccount" (list (index . 0) (index . 1)) | fromYaml -}}
+{{- if hasKey $sa.annotations "azure.workload.identity/client-id" -}}
+{{- $_ := set $labels "azure.workload.identity/use" "true" -}}
+{{- end -}}
+{{- if $labels -}}
+{{- toYaml $labels -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+ServiceAccounts of the components. Components sharing an account merge their annotations and
+labels, and the account is only created when none of them sets create to false.
+*/}}
+{{- define "neuvector.serviceAccounts" -}}
+{{- $accounts := dict -}}
+{{- $names := list -}}
+{{- range $component := list "manager" "controller" "enforcer" "scanner" "updater" "adapter" "certupgrader" -}}
+{{- $sa := include "neuvector.serviceAccount" (list $ $component) | fromYaml -}}
+{{- if hasKey $accounts $sa.name -}}
+{{- $account := index $accounts $sa.name -}}
+{{- $_ := set $account "create" (and $account.create $sa.create) -}}
+{{- $_ = set $account "annotations" (merge $account.annotations $sa.annotations) -}}
+{{- $_ = set $account "labels" (merge $account.labels $sa.labels) -}}
+{{- if kindIs "invalid" $account.automountServiceAccountToken -}}
+{{- $_ = set $account "automountServiceAccountToken" $sa.automountServiceAccountToken -}}
+{{- end -}}
+{{- else -}}
+{{- $_ := set $accounts $sa.name $sa -}}
+{{- $names = append $names $sa.name -}}
+{{- end -}}
+{{- end -}}
+{{- $docs := list -}}
+{{- range $name := $names -}}
+{{- $account := index $accounts $name -}}
+{{- if and $account.create (ne $name "default") -}}
+{{- $doc := printf "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: %s\n  namespace: %s\n  labels:\n    chart: %s\n    release: %s" $name $.Release.Namespace (include "neuvector.chart" $) $.Release.Name -}}
+{{- with $account.labels -}}
+{{- $doc = printf "%s%s" $doc (toYaml . | nindent 4) -}}
+{{- end -}}
+{{- with $account.annotations -}}
+{{- $doc = printf "%s\n  annotations:%s" $doc (toYaml . | nindent 4) -}}
+{{- end -}}
+{{- if not (kindIs "invalid" $account.automountServiceAccountToken) -}}
+{{- $doc = printf "%s\nautomountServiceAccountToken: %t" $doc $account.automountServiceAccountToken -}}
+{{- end -}}
+{{- $docs = append $docs $doc -}}
+{{- end -}}
+{{- end -}}
+{{- join "\n\n---\n\n" $docs -}}
+{{- end -}}
+
+{{/*
+RBAC subjects of the service accounts of the given components, or of all the accounts without
+leastPrivilege. Takes the root context followed by the components.
+*/}}
+{{- define "neuvector.rbac.subjects" -}}
+{{- $top := first . -}}
+{{- range $name := include "neuvector.rbac.names" . | fromJsonArray }}
+- kind: ServiceAccount
+  name: {{ $name }}
+  namespace: {{ $top.Release.Namespace }}
+{{- end -}}
+{{- end -}}
+
+{{- define "neuvector.rbac.userNames" -}}
+{{- $top := first . -}}
+{{- range $name := include "neuvector.rbac.names" . | fromJsonArray }}
+- system:serviceaccount:{{ $top.Release.Namespace }}:{{ $name }}
+{{- end -}}
+{{- end -}}
+
+{{- define "neuvector.rbac.names" -}}
+{{- $top := first . -}}
+{{- if $top.Values.leastPrivilege -}}
+{{- $names := list -}}
+{{- range $component := rest . -}}
+{{- $names = append $names (include "neuvector.serviceAccount.name" (list $top $component)) -}}
+{{- end -}}
+{{- toJson (uniq $names) -}}
+{{- else -}}
+{{- include "neuvector.serviceAccount.names" $top -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Resources of a component: its resources value, or the requests and limits of resourcesPreset.
+Takes a dict with the root context, the component and its resources value.
+*/}}
+{{- define "neuvector.resources" -}}
+{{- $resources := .resources -}}
+{{- $preset := .root.Values.resourcesPreset | default "none" -}}
+{{- if and (not $resources) (ne $preset "none") -}}
+{{- $resources = index (include "neuvector.resourcesPresets" . | fromYaml) $preset .component -}}
+{{- end -}}
+{{- toYaml ($resources | default dict) -}}
+{{- end -}}
+
+{{/*
+Requests and limits of each resourcesPreset. The jobs are sized for the updater, cert upgrader,
+prime init container and CSP billing adapter.
+*/}}
+{{- define "neuvector.resourcesPresets" -}}
+small:
+  controller: {requests: {cpu: 100m, memory: 1Gi}, limits: {cpu: 500m, memory: 2Gi}}
+  enforcer: {requests: {cpu: 100m, memory: 512Mi}, limits: {cpu: 500m, memory: 1Gi}}
+  manager: {requests: {cpu: 50m, memory: 256Mi}, limits: {cpu: 250m, memory: 512Mi}}
+  scanner: {requests: {cpu: 100m, memory: 1Gi}, limits: {cpu: "1", memory: 2Gi}}
+  adapter: {requests: {cpu: 50m, memory: 128Mi}, limits: {cpu: 250m, memory: 256Mi}}
+  job: {requests: {cpu: 50m, memory: 64Mi}, limits: {cpu: 100m, memory: 128Mi}}
+medium:
+  controller: {requests: {cpu: 250m, memory: 2Gi}, limits: {cpu: "1", memory: 3Gi}}
+  enforcer: {requests: {cpu: 200m, memory: 1Gi}, limits: {cpu: "1", memory: 2Gi}}
+  manager: {requests: {cpu: 100m, memory: 512Mi}, limits: {cpu: 500m, memory: 1Gi}}
+  scanner: {requests: {cpu: 250m, memory: 2Gi}, limits: {cpu: "2", memory: 3Gi}}
+  adapter: {requests: {cpu: 100m, memory: 256Mi}, limits: {cpu: 500m, memory: 512Mi}}
+  job: {requests: {cpu: 50m, memory: 128Mi}, limits: {cpu: 200m, memory: 256Mi}}
+large:
+  controller: {requests: {cpu: 500m, memory: 3Gi}, limits: {cpu: "2", memory: 4Gi}}
+  enforcer: {requests: {cpu: 400m, memory: 2Gi}, limits: {cpu: "2", memory: 3Gi}}
+  manager: {requests: {cpu: 200m, memory: 1Gi}, limits: {cpu: "1", memory: 2Gi}}
+  scanner: {requests: {cpu: 500m, memory: 3Gi}, limits: {cpu: "4", memory: 4Gi}}
+  adapter: {requests: {cpu: 200m, memory: 512Mi}, limits: {cpu: "1", memory: 1Gi}}
+  job: {requests: {cpu: 100m, memory: 128Mi}, limits: {cpu: 200m, memory: 256Mi}}
+xlarge:
+  controller: {requests: {cpu: "1", memory: 4Gi}, limits: {cpu: "4", memory: 8Gi}}
+  enforcer: {requests: {cpu: 800m, memory: 3Gi}, limits: {cpu: "4", memory: 6Gi}}
+  manager: {requests: {cpu: 400m, memory: 2Gi}, limits: {cpu: "2", memory: 4Gi}}
+  scanner: {requests: {cpu: "1", memory: 4Gi}, limits: {cpu: "8", memory: 8Gi}}
+  adapter: {requests: {cpu: 400m, memory: 1Gi}, limits: {cpu: "2", memory: 2Gi}}
+  job: {requests: {cpu: 100m, memory: 256Mi}, limits: {cpu: 500m, memory: 512Mi}}
+{{- end -}}
+
+{{/*
+Workloads that can have a VerticalPodAutoscaler, with their vpa values, as a yaml list.
+*/}}
+{{- define "neuvector.vpa.targets" -}}
+{{- $fullname := include "neuvector.fullname" . -}}
+- {component: controller, kind: Deployment, name: {{ $fullname }}-controller-pod, container: neuvector-controller-pod, enabled: {{ .Values.controller.enabled }}, vpa: {{ toJson .Values.controller.vpa }}}
+- {component: enforcer, kind: DaemonSet, name: {{ $fullname }}-enforcer-pod, container: neuvector-enforcer-pod, enabled: {{ .Values.enforcer.enabled }}, vpa: {{ toJson .Values.enforcer.vpa }}}
+- {component: manager, kind: Deployment, name: {{ $fullname }}-manager-pod, container: neuvector-manager-pod, enabled: {{ .Values.manager.enabled }}, vpa: {{ toJson .Values.manager.vpa }}}
+- {component: scanner, kind: Deployment, name: {{ $fullname }}-scanner-pod, container: neuvector-scanner-pod, enabled: {{ .Values.cve.scanner.enabled }}, vpa: {{ toJson .Values.cve.scanner.vpa }}}
+- {component: registry-adapter, kind: Deployment, name: {{ $fullname }}-registry-adapter-pod, container: neuvector-registry-adapter-pod, enabled: {{ .Values.cve.adapter.enabled }}, vpa: {{ toJson .Values.cve.adapter.vpa }}}
+{{- end -}}
+
+{{/*
+"true" when the controller autoscales the scanner, from Scanner_Autoscale of the sys init config
+in controller.initcfg, controller.secret or controller.configmap.
+*/}}
+{{- define "neuvector.scanner.autoscaled" -}}
+{{- $ctrl := .Values.controller -}}
+{{- $sys := list ($ctrl.initcfg.sys | default dict) -}}
+{{- if $ctrl.secret.enabled -}}
+{{- $sys = append $sys (index ($ctrl.secret.data | default dict) "sysinitcfg.yaml") -}}
+{{- end -}}
+{{- if $ctrl.configmap.enabled -}}
+{{- $sys = append $sys (index ($ctrl.configmap.data | default dict) "sysinitcfg.yaml") -}}
+{{- end -}}
+{{- range $cfg := $sys -}}
+{{- if kindIs "string" $cfg -}}
+{{- $cfg = fromYaml $cfg -}}
+{{- end -}}
+{{- if and (kindIs "map" $cfg) (dig "Scanner_Autoscale" "Strategy" "" ($cfg | default dict)) -}}
+true
+{{- end -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+"true" when a horizontal autoscaler manages the replicas of a workload: the scanner autoscaling
+of the controller, or a HorizontalPodAutoscaler of the release namespace. A VerticalPodAutoscaler
+would fight it over the same pods, so none is rendered. Takes (list root kind name).
+*/}}
+{{- define "neuvector.vpa.hpaManaged" -}}
+{{- $top := index . 0 -}}
+{{- $kind := index . 1 -}}
+{{- $name := index . 2 -}}
+{{- if and (eq $name (printf "%s-scanner-pod" (include "neuvector.fullname" $top))) (include "neuvector.scanner.autoscaled" $top) -}}
+true
+{{- else if and ($top.Capabilities.APIVersions.Has "autoscaling/v2") (not (include "neuvector.gitops.enabled" $top)) -}}
+{{- range (lookup "autoscaling/v2" "HorizontalPodAutoscaler" $top.Release.Namespace "").items -}}
+{{- if and (eq .spec.scaleTargetRef.kind $kind) (eq .spec.scaleTargetRef.name $name) -}}
+true
+{{- end -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Image of the updater, which also runs the cleanup hook: both only call the Kubernetes API with curl.
+*/}}
+{{- define "neuvector.updater.image" -}}
+{{- $image := .Values.cve.updater.image -}}
+{{- if eq .Values.registry "registry.neuvector.com" -}}
+{{- if .Values.oem -}}
+{{- printf "%s/%s/updater:%v" .Values.registry .Values.oem $image.tag -}}
+{{- else -}}
+{{- printf "%s/updater:%v" .Values.registry $image.tag -}}
+{{- end -}}
+{{- else if $image.hash -}}
+{{- printf "%s/%s@%v" .Values.registry $image.repository $image.hash -}}
+{{- else if $image.registry -}}
+{{- printf "%s/%s:%v" $image.registry $image.repository $image.tag -}}
+{{- else -}}
+{{- printf "%s/%s:%v" .Values.registry $image.repository $image.tag -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Image of the gitops Job. It comes from the registry of the other images, like the updater, except
+for docker.io which does not host the default bci-base image.
+*/}}
+{{- define "neuvector.gitops.image" -}}
+{{- $image := .Values.gitops.job.image -}}
+{{- $registry := $image.registry | default (ternary "registry.suse.com" .Values.registry (eq .Values.registry "docker.io")) -}}
+{{- if $image.hash -}}
+{{- printf "%s/%s@%v" $registry $image.repository $image.hash -}}
+{{- else -}}
+{{- printf "%s/%s:%v" $registry $image.repository $image.tag -}}
+{{- end -}}
+{{- end -}}
+
 {{- define "neuvector.controller.image" -}}
 {{- if .Values.global.azure.enabled }}
   {{- printf "%s/%s:%s" .Values.global.azure.images.controller.registry .Values.global.azure.images.controller.image .Values.global.azure.images.controller.tag }}
@@ -66,3 +400,333 @@ Lookup secret.
   {{- end }}
 {{- end }}
 {{- end -}}
+
+{{/*
+Self-signed serving certificate of a component. It is generated once per render and kept on the root
+context, so the secret, the checksum annotations and the routes all see the same certificate.
+*/}}
+{{- define "neuvector.cert.selfsigned" -}}
+{{- if not (hasKey .root "neuvectorCerts") -}}
+{{- $_ := set .root "neuvectorCerts" (dict) -}}
+{{- end -}}
+{{- if not (hasKey .root.neuvectorCerts .name) -}}
+{{- $altNames := include "neuvector.cert.altNames" . | fromYamlArray -}}
+{{- $_ := set .root.neuvectorCerts .name (genSelfSignedCert "neuvector" nil $altNames (.root.Values.defaultValidityPeriod | int)) -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+DNS names of the self-signed serving certificate of a component, its common name comes first.
+*/}}
+{{- define "neuvector.cert.altNames" -}}
+{{- $altNames := list "neuvector" -}}
+{{- if eq .name "registry-adapter" -}}
+{{- $svc := printf "%s-service-registry-adapter" (include "neuvector.fullname" .root) -}}
+{{- $altNames = list "neuvector" (print $svc "." (default "neuvector" .root.Release.Namespace) ".svc." (default "cluster.local" .root.Values.clusterDomain)) $svc -}}
+{{- end -}}
+{{- toYaml $altNames -}}
+{{- end -}}
+
+{{/*
+CA of the certificate served by a route backend, used as the destination CA of reencrypt routes.
+The CA of a certificate secret, of a certificate generated in the cluster in GitOps mode and of the
+built-in certificate is not known when rendering, it has to be set in route.tls.destinationCACertificate.
+*/}}
+{{- define "neuvector.route.destinationCA" -}}
+{{- if .certificate.secret -}}
+  {{- fail (printf "reencrypt routes of the %s need route.tls.destinationCACertificate when certificate.secret is set" .name) -}}
+{{- else if and .certificate.key .certificate.certificate -}}
+  {{- .certificate.certificate -}}
+{{- else if ne "true" (toString .root.Values.autoGenerateCert) -}}
+  {{- fail (printf "reencrypt routes of the %s need route.tls.destinationCACertificate when no certificate is set" .name) -}}
+{{- else if include "neuvector.gitops.enabled" .root -}}
+  {{- fail (printf "reencrypt routes of the %s need route.tls.destinationCACertificate with gitops.enabled, the certificate is generated in the cluster" .name) -}}
+{{- else -}}
+  {{- $existing := include "neuvector.secrets.lookup" (dict "namespace" .root.Release.Namespace "secret" .secret "key" "ssl-cert.pem") -}}
+  {{- if $existing -}}
+    {{- $existing | b64dec -}}
+  {{- else -}}
+    {{- include "neuvector.cert.selfsigned" (dict "root" .root "name" .name) -}}
+    {{- (index .root.neuvectorCerts .name).Cert -}}
+  {{- end -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+TLS section of an OpenShift route.
+*/}}
+{{- define "neuvector.route.tls" -}}
+{{- $tls := .route.tls | default (dict) -}}
+tls:
+  termination: {{ .route.termination }}
+{{- if or (eq .route.termination "reencrypt") (eq .route.termination "edge") }}
+{{- with $tls }}
+{{ toYaml . | indent 2 }}
+{{- end }}
+{{- if and (eq .route.termination "reencrypt") (not $tls.destinationCACertificate) }}
+{{- $ca := include "neuvector.route.destinationCA" . }}
+{{- if $ca }}
+  destinationCACertificate: |
+{{ $ca | trim | indent 4 }}
+{{- end }}
+{{- end }}
+{{- with .route.externalCertificate }}
+  externalCertificate:
+    name: {{ . }}
+{{- end }}
+{{- end }}
+{{- end -}}
+
+{{/*
+Base64 CA bundle of the chart-managed admission webhook configuration. With cert-manager the CA is
+injected by the cainjector instead, and the internal certificate secrets are read from the cluster,
+so the bundle is empty until they exist, and in GitOps mode.
+*/}}
+{{- define "neuvector.admissionwebhook.caBundle" -}}
+{{- $cfg := .Values.admissionwebhook.configuration -}}
+{{- if $cfg.caBundle -}}
+{{- $cfg.caBundle -}}
+{{- else if or .Values.internal.certmanager.enabled (include "neuvector.gitops.enabled" .) -}}
+{{- else if .Values.controller.internal.certificate.secret -}}
+{{- include "neuvector.secrets.lookup" (dict "namespace" .Release.Namespace "secret" .Values.controller.internal.certificate.secret "key" .Values.controller.internal.certificate.caFile) -}}
+{{- else if .Values.internal.autoGenerateCert -}}
+{{- include "neuvector.secrets.lookup" (dict "namespace" .Release.Namespace "secret" "neuvector-internal-certs" "key" "ca.crt") -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+"true" in GitOps mode. The gitops key is missing when helm upgrade --reuse-values keeps the values of
+a chart version before GitOps mode.
+*/}}
+{{- define "neuvector.gitops.enabled" -}}
+{{- if (.Values.gitops | default dict).enabled -}}
+true
+{{- end -}}
+{{- end -}}
+
+{{/*
+Annotations of an object, with its Argo CD sync wave in GitOps mode: crds, secrets or workloads. The
+annotations given win. Takes (list root group annotations) and renders the annotations key, if any.
+*/}}
+{{- define "neuvector.gitops.annotations" -}}
+{{- $top := index . 0 -}}
+{{- $annotations := deepCopy (index . 2 | default dict) -}}
+{{- if include "neuvector.gitops.enabled" $top -}}
+{{- $wave := index ($top.Values.gitops.syncWaves | default dict) (index . 1) -}}
+{{- if not (kindIs "invalid" $wave) -}}
+{{- $annotations = merge $annotations (dict "argocd.argoproj.io/sync-wave" (toString $wave)) -}}
+{{- end -}}
+{{- end -}}
+{{- with $annotations -}}
+annotations:
+  {{- toYaml . | nindent 2 }}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Self-signed certificates created in the cluster in GitOps mode, by the gitops Job or cert-manager,
+instead of being generated by the chart. Maps the components that use an autoGenerateCert certificate
+to its secret.
+*/}}
+{{- define "neuvector.gitops.certs" -}}
+{{- $certs := dict -}}
+{{- if and (include "neuvector.gitops.enabled" .) (eq "true" (toString .Values.autoGenerateCert)) -}}
+{{- range $component, $values := dict "controller" .Values.controller "manager" .Values.manager "registry-adapter" .Values.cve.adapter -}}
+{{- $cert := $values.certificate -}}
+{{- if and $values.enabled (not $cert.secret) (not (and $cert.key $cert.certificate)) -}}
+{{- $_ := set $certs $component (printf "%s-%s-secret" (include "neuvector.fullname" $) $component) -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+{{- toYaml $certs -}}
+{{- end -}}
+
+{{/*
+Federation role of the cluster, master, managed or none.
+*/}}
+{{- define "neuvector.federation.role" -}}
+{{- $role := toString (.Values.controller.federation.role | default "none") -}}
+{{- if ne $role "none" -}}
+{{- $role -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Service type of the federation master and managed services. The service of the federation
+role is created as ClusterIP unless a type is set.
+*/}}
+{{- define "neuvector.federation.mastersvc.type" -}}
+{{- .Values.controller.federation.mastersvc.type | default (ternary "ClusterIP" "" (eq (include "neuvector.federation.role" .) "master")) -}}
+{{- end -}}
+
+{{- define "neuvector.federation.managedsvc.type" -}}
+{{- .Values.controller.federation.managedsvc.type | default (ternary "ClusterIP" "" (eq (include "neuvector.federation.role" .) "managed")) -}}
+{{- end -}}
+
+{{/*
+Federation REST endpoint, the address if set, else the ingress host, the route host or the load
+balancer IP of the federation service.
+*/}}
+{{- define "neuvector.federation.endpoint" -}}
+{{- $svc := .svc -}}
+{{- if .address -}}
+server: {{ .address | quote }}
+port: {{ .port | default .servicePort }}
+{{- else if and $svc.ingress.enabled $svc.ingress.host -}}
+server: {{ $svc.ingress.host | quote }}
+port: {{ .port | default 443 }}
+{{- else if and .openshift $svc.route.enabled $svc.route.host -}}
+server: {{ $svc.route.host | quote }}
+port: {{ .port | default 443 }}
+{{- else if and (eq (toString $svc.type) "LoadBalancer") $svc.loadBalancerIP -}}
+server: {{ $svc.loadBalancerIP | quote }}
+port: {{ .port | default .servicePort }}
+{{- end -}}
+{{- end -}}
+
+{{/*
+fedinitcfg.yaml of the federation role.
+*/}}
+{{- define "neuvector.federation.initcfg" -}}
+{{- $fed := .Values.controller.federation -}}
+{{- $role := include "neuvector.federation.role" . -}}
+{{- $openshift := include "neuvector.openshift" . -}}
+{{- if not $fed.clusterName -}}
+{{- fail (printf "controller.federation.clusterName is required for the %s role" $role) -}}
+{{- end -}}
+{{- $cfg := dict "fed_role" (ternary "master" "joint" (eq $role "master")) "name" $fed.clusterName -}}
+{{- $master := include "neuvector.federation.endpoint" (dict "address" $fed.master.address "port" $fed.master.port "svc" (ternary $fed.mastersvc (dict "ingress" (dict) "route" (dict)) (eq $role "master")) "servicePort" 11443 "openshift" $openshift) | fromYaml -}}
+{{- if not $master.server -}}
+{{- if eq $role "master" -}}
+{{- fail "controller.federation.master.address is required, or expose controller.federation.mastersvc with an ingress host, a route host or a load balancer IP" -}}
+{{- else -}}
+{{- fail "controller.federation.master.address of the primary cluster is required for the managed role" -}}
+{{- end -}}
+{{- end -}}
+{{- if eq $role "master" -}}
+{{- $_ := set $cfg "master_rest_info" $master -}}
+{{- else -}}
+{{- if not $fed.joinToken.secretName -}}
+{{- fail "controller.federation.joinToken.secretName is required for the managed role" -}}
+{{- end -}}
+{{- $managed := include "neuvector.federation.endpoint" (dict "address" $fed.managed.address "port" $fed.managed.port "svc" $fed.managedsvc "servicePort" .Values.controller.apisvc.ctrlServerPort "openshift" $openshift) | fromYaml -}}
+{{- if not $managed.server -}}
+{{- fail "controller.federation.managed.address is required, or expose controller.federation.managedsvc with an ingress host, a route host or a load balancer IP" -}}
+{{- end -}}
+{{- $_ := set $cfg "server" $master.server -}}
+{{- $_ := set $cfg "port" $master.port -}}
+{{- $_ := set $cfg "join_token" (include "neuvector.initcfg.secretPlaceholder" (dict "name" $fed.joinToken.secretName "key" $fed.joinToken.secretKey)) -}}
+{{- $_ := set $cfg "joint_rest_info" $managed -}}
+{{- end -}}
+{{- with $fed.useProxy -}}
+{{- $_ := set $cfg "use_proxy" . -}}
+{{- end -}}
+{{- toYaml $cfg -}}
+{{- end -}}
+
+{{/*
+Environment variable of the init-config init container that holds a secret key of the init config files.
+*/}}
+{{- define "neuvector.initcfg.secretEnv" -}}
+{{- printf "NV_SECRET_%s" (printf "%s/%s" .name .key | sha256sum | trunc 8 | upper) -}}
+{{- end -}}
+
+{{/*
+Placeholder of a secret key in the init config files. The secret is not read at render time, the init-config
+init container of the controller replaces the placeholder with the value of its environment variable.
+*/}}
+{{- define "neuvector.initcfg.secretPlaceholder" -}}
+{{- printf "${%s}" (include "neuvector.initcfg.secretEnv" .) -}}
+{{- end -}}
+
+{{/*
+Secret keys referenced by the init config files, as a list of the environment variable, secret name and key.
+*/}}
+{{- define "neuvector.initcfg.secretRefs" -}}
+{{- $refs := dict -}}
+{{- if eq (include "neuvector.federation.role" .) "managed" -}}
+{{- $token := .Values.controller.federation.joinToken -}}
+{{- $_ := set $refs (include "neuvector.initcfg.secretEnv" (dict "name" $token.secretName "key" $token.secretKey)) (dict "name" $token.secretName "key" $token.secretKey) -}}
+{{- end -}}
+{{- range $name, $cfg := .Values.controller.initcfg -}}
+{{- if $cfg -}}
+{{- include "neuvector.initcfg.resolve" (dict "value" (deepCopy $cfg) "refs" $refs) -}}
+{{- end -}}
+{{- end -}}
+{{- $list := list -}}
+{{- range $env, $ref := $refs -}}
+{{- $list = append $list (dict "env" $env "name" $ref.name "key" $ref.key) -}}
+{{- end -}}
+{{- toYaml $list -}}
+{{- end -}}
+
+{{/*
+Replace the secretKeyRef fields of an init config section with the placeholders of the secret keys, in place.
+The secret keys are added to the refs dict, keyed by their environment variable.
+*/}}
+{{- define "neuvector.initcfg.resolve" -}}
+{{- if kindIs "map" .value -}}
+{{- range $k, $v := .value -}}
+{{- if and (kindIs "map" $v) (hasKey $v "secretKeyRef") -}}
+{{- $_ := set $.value $k (include "neuvector.initcfg.secretPlaceholder" $v.secretKeyRef) -}}
+{{- $_ := set $.refs (include "neuvector.initcfg.secretEnv" $v.secretKeyRef) (pick $v.secretKeyRef "name" "key") -}}
+{{- else -}}
+{{- include "neuvector.initcfg.resolve" (dict "value" $v "refs" $.refs) -}}
+{{- end -}}
+{{- end -}}
+{{- else if kindIs "slice" .value -}}
+{{- range .value -}}
+{{- include "neuvector.initcfg.resolve" (dict "value" . "refs" $.refs) -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Base64 encoded init config files generated from controller.initcfg and controller.federation.role,
+keyed by file name. Each file cannot also be set in controller.configmap.data or controller.secret.data.
+*/}}
+{{- define "neuvector.initcfg.files" -}}
+{{- $files := dict -}}
+{{- $sources := dict -}}
+{{- range $name, $cfg := .Values.controller.initcfg -}}
+{{- if $cfg -}}
+{{- $cfg = deepCopy $cfg -}}
+{{- include "neuvector.initcfg.resolve" (dict "value" $cfg "refs" dict) -}}
+{{- $file := printf "%sinitcfg.yaml" $name -}}
+{{- /* toYaml drops the final newline, which a block scalar of the last key keeps */ -}}
+{{- $_ := set $files $file (printf "%s\n" (toYaml $cfg) | b64enc) -}}
+{{- $_ := set $sources $file (printf "controller.initcfg.%s" $name) -}}
+{{- end -}}
+{{- end -}}
+{{- if include "neuvector.federation.role" . -}}
+{{- $_ := set $files "fedinitcfg.yaml" (printf "%s\n" (include "neuvector.federation.initcfg" .) | b64enc) -}}
+{{- $_ := set $sources "fedinitcfg.yaml" "controller.federation.role" -}}
+{{- end -}}
+{{- range $file, $source := $sources -}}
+{{- if and $.Values.controller.configmap.enabled (hasKey ($.Values.controller.configmap.data | default (dict)) $file) -}}
+{{- fail (printf "controller.configmap.data.%s cannot be set with %s" $file $source) -}}
+{{- end -}}
+{{- if and $.Values.controller.secret.enabled (hasKey ($.Values.controller.secret.data | default (dict)) $file) -}}
+{{- fail (printf "controller.secret.data.%s cannot be set with %s" $file $source) -}}
+{{- end -}}
+{{- end -}}
+{{- if $files -}}
+{{- toYaml $files -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+bootstrapPassword as an object, a string is the deprecated form of bootstrapPassword.value.
+AWS billing generates the password unless it is set.
+*/}}
+{{- define "neuvector.bootstrapPassword" -}}
+{{- $bp := .Values.bootstrapPassword | default dict -}}
+{{- if not (kindIs "map" $bp) -}}
+{{- $bp = dict "value" (toString $bp) -}}
+{{- end -}}
+{{- $bp = merge (dict) $bp (dict "value" "" "existingSecret" "" "key" "bootstrapPassword" "generate" false "keep" false) -}}
+{{- if and .Values.global.aws.enabled (not $bp.value) (not $bp.existingSecret) -}}
+{{- $_ := set $bp "generate" true -}}
+{{- end -}}
+{{- toYaml $bp -}}
+{{- end -}}
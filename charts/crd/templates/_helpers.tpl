@@ -30,3 +30,36 @@ Create chart name and version as used by the chart label.
 {{- define "neuvector.chart" -}}
 {{- printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" | trunc 63 | trimSuffix "-" -}}
 {{- end -}}
+
+{{/*
+Detect OpenShift. "openshift" can be true, false or auto. With auto, the cluster is treated as
+OpenShift when the route or security API groups are served. Returns "true" or an empty string.
+*/}}
+{{- define "neuvector.openshift" -}}
+{{- if eq (toString .Values.openshift) "auto" -}}
+{{- if or (.Capabilities.APIVersions.Has "route.openshift.io/v1") (.Capabilities.APIVersions.Has "security.openshift.io/v1") -}}
+true
+{{- end -}}
+{{- else if .Values.openshift -}}
+true
+{{- end -}}
+{{- end -}}
+
+{{/*
+Annotations of an object, with its Argo CD sync wave in GitOps mode. Takes (list root group annotations)
+and renders the annotations key, if any, as in the core chart.
+*/}}
+{{- define "neuvector.gitops.annotations" -}}
+{{- $top := index . 0 -}}
+{{- $annotations := deepCopy (index . 2 | default dict) -}}
+{{- if ($top.Values.gitops | default dict).enabled -}}
+{{- $wave := index ($top.Values.gitops.syncWaves | default dict) (index . 1) -}}
+{{- if not (kindIs "invalid" $wave) -}}
+{{- $annotations = merge $annotations (dict "argocd.argoproj.io/sync-wave" (toString $wave)) -}}
+{{- end -}}
+{{- end -}}
+{{- with $annotations -}}
+annotations:
+  {{- toYaml . | nindent 2 }}
+{{- end -}}
+{{- end -}}
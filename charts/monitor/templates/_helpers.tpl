@@ -7,21 +7,22 @@ Expand the name of the chart.
 {{- end -}}
 
 {{/*
-Create a default fully qualified app name.
-We truncate at 63 chars because some Kubernetes name fields are limited to this (by the DNS naming spec).
-If release name contains chart name it will be used as a full name.
+Prefix of the resource names. It stays "neuvector" by default so that upgrades keep the existing names.
+fullnameOverride replaces the prefix, and nameOverride is used as the prefix when fullnameOverride is not set.
 */}}
 {{- define "neuvector.fullname" -}}
 {{- if .Values.fullnameOverride -}}
-{{- .Values.fullnameOverride | trunc 63 | trimSuffix "-" -}}
+{{- .Values.fullnameOverride | trunc 36 | trimSuffix "-" -}}
 {{- else -}}
-{{- $name := default .Chart.Name .Values.nameOverride -}}
-{{- if contains $name .Release.Name -}}
-{{- .Release.Name | trunc 63 | trimSuffix "-" -}}
-{{- else -}}
-{{- printf "%s-%s" .Release.Name $name | trunc 63 | trimSuffix "-" -}}
+{{- default "neuvector" .Values.nameOverride | trunc 36 | trimSuffix "-" -}}
 {{- end -}}
 {{- end -}}
+
+{{/*
+Controller REST API service and port read by the exporter. The default assumes the core chart uses the same fullname.
+*/}}
+{{- define "neuvector.exporter.apiSvc" -}}
+{{- .Values.exporter.apiSvc | default (printf "%s-svc-controller-api:10443" (include "neuvector.fullname" .)) -}}
 {{- end -}}
 
 {{/*
@@ -30,3 +31,37 @@ Create chart name and version as used by the chart label.
 {{- define "neuvector.chart" -}}
 {{- printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" | trunc 63 | trimSuffix "-" -}}
 {{- end -}}
+
+{{/*
+Image pull secret entries. imagePullSecrets is a list of secret names or {name: ...} objects,
+a single string is deprecated.
+*/}}
+{{- define "neuvector.imagePullSecrets" -}}
+{{- $secrets := list -}}
+{{- range (kindIs "string" . | ternary (list .) .) -}}
+{{- if kindIs "string" . -}}
+{{- $secrets = append $secrets (dict "name" .) -}}
+{{- else -}}
+{{- $secrets = append $secrets (dict "name" .name) -}}
+{{- end -}}
+{{- end -}}
+{{- toYaml $secrets -}}
+{{- end -}}
+
+{{/*
+Resources of the exporter: exporter.resources, or the requests and limits of resourcesPreset.
+The presets match the ones of the core chart.
+*/}}
+{{- define "neuvector.exporter.resources" -}}
+{{- $presets := dict
+  "small" (dict "requests" (dict "cpu" "50m" "memory" "64Mi") "limits" (dict "cpu" "100m" "memory" "128Mi"))
+  "medium" (dict "requests" (dict "cpu" "50m" "memory" "128Mi") "limits" (dict "cpu" "200m" "memory" "256Mi"))
+  "large" (dict "requests" (dict "cpu" "100m" "memory" "128Mi") "limits" (dict "cpu" "200m" "memory" "256Mi"))
+  "xlarge" (dict "requests" (dict "cpu" "100m" "memory" "256Mi") "limits" (dict "cpu" "500m" "memory" "512Mi")) -}}
+{{- $resources := .Values.exporter.resources -}}
+{{- $preset := .Values.resourcesPreset | default "none" -}}
+{{- if and (not $resources) (ne $preset "none") -}}
+{{- $resources = index $presets $preset -}}
+{{- end -}}
+{{- toYaml ($resources | default dict) -}}
+{{- end -}}
@@ -0,0 +1,251 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admissionWebhookConfiguration returns the chart-managed admission webhook configuration of the
+// rendered templates, or nil.
+func admissionWebhookConfiguration(t *testing.T, out map[string]string) *admissionv1.ValidatingWebhookConfiguration {
+	for name, manifest := range out {
+		if !strings.HasSuffix(name, "admission-webhook-configuration.yaml") || strings.TrimSpace(manifest) == "" {
+			continue
+		}
+		var cfg admissionv1.ValidatingWebhookConfiguration
+		helm.UnmarshalK8SYaml(t, manifest, &cfg)
+		return &cfg
+	}
+	return nil
+}
+
+func TestAdmissionWebhookControllerOwned(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{"cleanup.enabled": "true"},
+		Logger:    logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+	if _, ok := objs["Service/neuvector-svc-admission-webhook"]; !ok {
+		t.Errorf("Admission webhook service is not rendered\n")
+	}
+	for name := range objs {
+		if strings.HasPrefix(name, "ValidatingWebhookConfiguration/") {
+			t.Errorf("%s should be created by the controller\n", name)
+		}
+	}
+
+	// the cleanup hook removes the configuration the controller created
+	if !strings.Contains(objs["Job/neuvector-cleanup-pod"], "validatingwebhookconfigurations/neuvector-validating-admission-webhook") {
+		t.Errorf("Cleanup job should delete the admission webhook configuration\n")
+	}
+}
+
+func TestAdmissionWebhookChartOwned(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"admissionwebhook.configuration.enabled":                               "true",
+			"admissionwebhook.configuration.failurePolicy":                         "Fail",
+			"admissionwebhook.configuration.timeoutSeconds":                        "10",
+			"admissionwebhook.configuration.excludedNamespaces":                    "{kube-system,cattle-system}",
+			"admissionwebhook.configuration.namespaceSelector.matchLabels.managed": "neuvector",
+			"admissionwebhook.configuration.objectSelector.matchLabels.validate":   "yes",
+			"admissionwebhook.configuration.matchConditions[0].name":               "not-leases",
+			"admissionwebhook.configuration.matchConditions[0].expression":         "request.resource.group != 'coordination.k8s.io'",
+			"admissionwebhook.configuration.caBundle":                              "Y2E=",
+			"cleanup.enabled": "true",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options, "--kube-version", "1.30.0")
+	if _, ok := objs["Service/neuvector-svc-admission-webhook"]; !ok {
+		t.Errorf("Admission webhook service is not rendered\n")
+	}
+	var cfg admissionv1.ValidatingWebhookConfiguration
+	helm.UnmarshalK8SYaml(t, objs["ValidatingWebhookConfiguration/neuvector-chart-validating-admission-webhook"], &cfg)
+	if len(cfg.Webhooks) != 1 {
+		t.Fatalf("Unexpected webhooks. webhooks=%+v\n", cfg.Webhooks)
+	}
+	w := cfg.Webhooks[0]
+	if w.Name != "neuvector-chart-validating-admission-webhook.default.svc" {
+		t.Errorf("Webhook name is wrong. name=%v\n", w.Name)
+	}
+	if *w.FailurePolicy != admissionv1.Fail || *w.TimeoutSeconds != 10 || *w.SideEffects != admissionv1.SideEffectClassNone {
+		t.Errorf("Webhook policy is wrong. failurePolicy=%v timeoutSeconds=%v sideEffects=%v\n", *w.FailurePolicy, *w.TimeoutSeconds, *w.SideEffects)
+	}
+	svc := w.ClientConfig.Service
+	if svc == nil || svc.Name != "neuvector-svc-admission-webhook" || svc.Namespace != "default" || *svc.Port != 443 || *svc.Path != "/v1/validate" {
+		t.Errorf("Webhook service is wrong. service=%+v\n", svc)
+	}
+	if string(w.ClientConfig.CABundle) != "ca" {
+		t.Errorf("Webhook caBundle is wrong. caBundle=%s\n", w.ClientConfig.CABundle)
+	}
+	if len(w.Rules) != 1 || len(w.Rules[0].Resources) != 8 {
+		t.Errorf("Webhook rules are wrong. rules=%+v\n", w.Rules)
+	}
+
+	expected := metav1.LabelSelector{
+		MatchLabels: map[string]string{"managed": "neuvector"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      "kubernetes.io/metadata.name",
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{"default", "kube-system", "cattle-system"},
+		}},
+	}
+	if w.NamespaceSelector.String() != expected.String() {
+		t.Errorf("Webhook namespace selector is wrong. namespaceSelector=%v\n", w.NamespaceSelector)
+	}
+	if w.ObjectSelector.MatchLabels["validate"] != "yes" {
+		t.Errorf("Webhook object selector is wrong. objectSelector=%v\n", w.ObjectSelector)
+	}
+	if len(w.MatchConditions) != 1 || w.MatchConditions[0].Name != "not-leases" {
+		t.Errorf("Webhook match conditions are wrong. matchConditions=%+v\n", w.MatchConditions)
+	}
+
+	// helm uninstall removes the chart-managed configuration, the cleanup hook only deletes the one
+	// the controller keeps creating
+	if strings.Contains(objs["Job/neuvector-cleanup-pod"], "neuvector-chart-validating-admission-webhook") ||
+		strings.Contains(objs["ClusterRole/neuvector-binding-cleanup"], "neuvector-chart-validating-admission-webhook") {
+		t.Errorf("Cleanup hook should not delete the chart-managed admission webhook configuration\n")
+	}
+	if !strings.Contains(objs["Job/neuvector-cleanup-pod"], "validatingwebhookconfigurations/neuvector-validating-admission-webhook") {
+		t.Errorf("Cleanup hook should delete the admission webhook configuration of the controller\n")
+	}
+
+	// match conditions are not served before Kubernetes 1.28
+	_, err := helm.RenderTemplateE(t, options, "../charts/core", nvRel, []string{}, "--kube-version", "1.27.0")
+	if err == nil || !strings.Contains(err.Error(), "matchConditions requires Kubernetes 1.28") {
+		t.Errorf("matchConditions should be rejected before Kubernetes 1.28. error=%v\n", err)
+	}
+}
+
+func TestAdmissionWebhookDefaultSelector(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"admissionwebhook.configuration.enabled": "true",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+	var cfg admissionv1.ValidatingWebhookConfiguration
+	helm.UnmarshalK8SYaml(t, objs["ValidatingWebhookConfiguration/neuvector-chart-validating-admission-webhook"], &cfg)
+	w := cfg.Webhooks[0]
+	if *w.FailurePolicy != admissionv1.Ignore || *w.TimeoutSeconds != 30 {
+		t.Errorf("Webhook policy is wrong. failurePolicy=%v timeoutSeconds=%v\n", *w.FailurePolicy, *w.TimeoutSeconds)
+	}
+	selector := w.NamespaceSelector
+	if len(selector.MatchLabels) != 0 || len(selector.MatchExpressions) != 1 ||
+		strings.Join(selector.MatchExpressions[0].Values, ",") != "default,kube-system" {
+		t.Errorf("Webhook namespace selector is wrong. namespaceSelector=%v\n", selector)
+	}
+	if w.ObjectSelector != nil || len(w.MatchConditions) != 0 {
+		t.Errorf("Webhook selectors are wrong. objectSelector=%v matchConditions=%v\n", w.ObjectSelector, w.MatchConditions)
+	}
+}
+
+func TestAdmissionWebhookCABundle(t *testing.T) {
+	secret := func(name string, key string) corev1.Secret {
+		return corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "neuvector"},
+			Data:       map[string][]byte{key: []byte(name + " ca")},
+		}
+	}
+
+	cases := []struct {
+		name       string
+		values     map[string]string
+		secrets    []corev1.Secret
+		caBundle   string
+		injectFrom string
+		// failurePolicy rendered for failurePolicy=Fail
+		failurePolicy admissionv1.FailurePolicyType
+	}{
+		{
+			name:          "cert upgrader",
+			values:        map[string]string{},
+			secrets:       []corev1.Secret{secret("neuvector-internal-certs", "ca.crt")},
+			caBundle:      "neuvector-internal-certs ca",
+			failurePolicy: admissionv1.Fail,
+		},
+		{
+			name:          "cert upgrader first install",
+			values:        map[string]string{},
+			failurePolicy: admissionv1.Ignore,
+		},
+		{
+			name:          "gitops",
+			values:        map[string]string{"gitops.enabled": "true"},
+			secrets:       []corev1.Secret{secret("neuvector-internal-certs", "ca.crt")},
+			failurePolicy: admissionv1.Ignore,
+		},
+		{
+			name: "gitops with cert-manager",
+			values: map[string]string{
+				"gitops.enabled":                         "true",
+				"internal.certmanager.enabled":           "true",
+				"controller.internal.certificate.secret": "neuvector-internal",
+			},
+			injectFrom:    "neuvector/neuvector-internal",
+			failurePolicy: admissionv1.Fail,
+		},
+		{
+			name: "internal certificate secret",
+			values: map[string]string{
+				"controller.internal.certificate.secret": "internal",
+				"controller.internal.certificate.caFile": "root.pem",
+			},
+			secrets:       []corev1.Secret{secret("internal", "root.pem"), secret("neuvector-internal-certs", "ca.crt")},
+			caBundle:      "internal ca",
+			failurePolicy: admissionv1.Fail,
+		},
+		{
+			name: "cert-manager",
+			values: map[string]string{
+				"internal.certmanager.enabled":           "true",
+				"controller.internal.certificate.secret": "neuvector-internal",
+			},
+			secrets:       []corev1.Secret{secret("neuvector-internal", "ca.crt")},
+			injectFrom:    "neuvector/neuvector-internal",
+			failurePolicy: admissionv1.Fail,
+		},
+		{
+			name: "explicit",
+			values: map[string]string{
+				"internal.certmanager.enabled":            "true",
+				"admissionwebhook.configuration.caBundle": "ZXhwbGljaXQgY2E=",
+			},
+			caBundle:      "explicit ca",
+			failurePolicy: admissionv1.Fail,
+		},
+	}
+
+	for _, c := range cases {
+		values := mergeValues(map[string]string{
+			"admissionwebhook.configuration.enabled":       "true",
+			"admissionwebhook.configuration.failurePolicy": "Fail",
+		}, c.values)
+		out, err := renderWithSecrets(t, "core", values, c.secrets...)
+		if err != nil {
+			t.Fatalf("%s: failed to render chart. error=%v\n", c.name, err)
+		}
+		cfg := admissionWebhookConfiguration(t, out)
+		if cfg == nil {
+			t.Fatalf("%s: admission webhook configuration is not rendered\n", c.name)
+		}
+		if caBundle := string(cfg.Webhooks[0].ClientConfig.CABundle); caBundle != c.caBundle {
+			t.Errorf("%s: caBundle is wrong. caBundle=%v\n", c.name, caBundle)
+		}
+		if injectFrom := cfg.Annotations["cert-manager.io/inject-ca-from"]; injectFrom != c.injectFrom {
+			t.Errorf("%s: cert-manager injection is wrong. inject-ca-from=%v\n", c.name, injectFrom)
+		}
+		// a webhook the API server cannot verify must not reject requests
+		if policy := *cfg.Webhooks[0].FailurePolicy; policy != c.failurePolicy {
+			t.Errorf("%s: failurePolicy is wrong. failurePolicy=%v\n", c.name, policy)
+		}
+	}
+}
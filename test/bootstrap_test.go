@@ -0,0 +1,226 @@
+package test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func bootstrapSecret(t *testing.T, out map[string]string) *corev1.Secret {
+	doc := out["core/templates/bootstrap-secret.yaml"]
+	if strings.TrimSpace(doc) == "" {
+		return nil
+	}
+	var secret corev1.Secret
+	helm.UnmarshalK8SYaml(t, doc, &secret)
+	return &secret
+}
+
+func existingSecret(name string, key string, value string) corev1.Secret {
+	return corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "neuvector"},
+		Data:       map[string][]byte{key: []byte(value)},
+	}
+}
+
+func TestBootstrapPassword(t *testing.T) {
+	cases := []struct {
+		name     string
+		values   map[string]string
+		secrets  []corev1.Secret
+		password string
+		keep     bool
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:     "value",
+			values:   map[string]string{"bootstrapPassword.value": "Admin-Password1"},
+			password: "Admin-Password1",
+		},
+		{
+			name:     "deprecated string",
+			values:   map[string]string{"bootstrapPassword": "Admin-Password1"},
+			password: "Admin-Password1",
+		},
+		{
+			name:    "existing secret",
+			values:  map[string]string{"bootstrapPassword.existingSecret": "admin-password", "bootstrapPassword.key": "password"},
+			secrets: []corev1.Secret{existingSecret("admin-password", "password", "Existing-Password1")},
+		},
+		{
+			name:    "existing bootstrap secret",
+			values:  map[string]string{"bootstrapPassword.existingSecret": "neuvector-bootstrap-secret"},
+			secrets: []corev1.Secret{existingSecret("neuvector-bootstrap-secret", "bootstrapPassword", "Existing-Password1")},
+		},
+		{
+			name:     "value before existing secret",
+			values:   map[string]string{"bootstrapPassword.value": "Admin-Password1", "bootstrapPassword.existingSecret": "admin-password"},
+			password: "Admin-Password1",
+		},
+		{
+			name:     "generated password is kept",
+			values:   map[string]string{"bootstrapPassword.generate": "true"},
+			secrets:  []corev1.Secret{existingSecret("neuvector-bootstrap-secret", "bootstrapPassword", "Generated-Password1")},
+			password: "Generated-Password1",
+		},
+		{
+			name:     "aws password is kept",
+			values:   map[string]string{"global.aws.enabled": "true"},
+			secrets:  []corev1.Secret{existingSecret("neuvector-bootstrap-secret", "bootstrapPassword", "Generated-Password1")},
+			password: "Generated-Password1",
+		},
+		{
+			name:     "aws with a password",
+			values:   map[string]string{"global.aws.enabled": "true", "bootstrapPassword.value": "Admin-Password1"},
+			secrets:  []corev1.Secret{existingSecret("neuvector-bootstrap-secret", "bootstrapPassword", "Generated-Password1")},
+			password: "Admin-Password1",
+		},
+		{
+			name:     "keep",
+			values:   map[string]string{"bootstrapPassword.value": "Admin-Password1", "bootstrapPassword.keep": "true"},
+			password: "Admin-Password1",
+			keep:     true,
+		},
+	}
+
+	for _, c := range cases {
+		out, err := renderWithSecrets(t, "core", c.values, c.secrets...)
+		if err != nil {
+			t.Errorf("%s: failed to render chart. error=%v\n", c.name, err)
+			continue
+		}
+
+		secret := bootstrapSecret(t, out)
+		if c.password == "" {
+			if secret != nil {
+				t.Errorf("%s: bootstrap secret should not be rendered. secret=%+v\n", c.name, secret)
+			}
+			continue
+		}
+		if secret == nil {
+			t.Errorf("%s: bootstrap secret is not rendered\n", c.name)
+			continue
+		}
+		if secret.Name != "neuvector-bootstrap-secret" {
+			t.Errorf("%s: bootstrap secret name is wrong. name=%v\n", c.name, secret.Name)
+		}
+		if string(secret.Data["bootstrapPassword"]) != c.password {
+			t.Errorf("%s: bootstrap password is wrong. password=%v\n", c.name, string(secret.Data["bootstrapPassword"]))
+		}
+		if policy := secret.Annotations["helm.sh/resource-policy"]; (policy == "keep") != c.keep {
+			t.Errorf("%s: resource policy is wrong. policy=%v\n", c.name, policy)
+		}
+	}
+}
+
+func TestBootstrapPasswordExistingSecret(t *testing.T) {
+	cases := []struct {
+		name   string
+		values map[string]string
+		ref    *corev1.SecretKeySelector
+	}{
+		{
+			name:   "existing secret",
+			values: map[string]string{"bootstrapPassword.existingSecret": "admin-password", "bootstrapPassword.key": "password"},
+			ref:    &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "admin-password"}, Key: "password"},
+		},
+		{
+			name:   "existing bootstrap secret",
+			values: map[string]string{"bootstrapPassword.existingSecret": "neuvector-bootstrap-secret"},
+			ref:    &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "neuvector-bootstrap-secret"}, Key: "bootstrapPassword"},
+		},
+		{
+			name:   "value before existing secret",
+			values: map[string]string{"bootstrapPassword.value": "Admin-Password1", "bootstrapPassword.existingSecret": "admin-password"},
+		},
+		{
+			name: "default",
+		},
+	}
+
+	for _, c := range cases {
+		// the secret is not in the cluster, the chart does not read it
+		out, err := renderWithSecrets(t, "core", c.values)
+		if err != nil {
+			t.Errorf("%s: failed to render chart. error=%v\n", c.name, err)
+			continue
+		}
+
+		var deploy appsv1.Deployment
+		helm.UnmarshalK8SYaml(t, out["core/templates/controller-deployment.yaml"], &deploy)
+		var ref *corev1.SecretKeySelector
+		for _, env := range deploy.Spec.Template.Spec.Containers[0].Env {
+			if env.Name == "NV_BOOTSTRAP_PASSWORD" {
+				ref = env.ValueFrom.SecretKeyRef
+			}
+		}
+		if !reflect.DeepEqual(ref, c.ref) {
+			t.Errorf("%s: bootstrap password reference is wrong. expected=%+v actual=%+v\n", c.name, c.ref, ref)
+		}
+	}
+}
+
+func TestBootstrapPasswordGenerate(t *testing.T) {
+	values := map[string]string{"bootstrapPassword.generate": "true"}
+
+	// without a secret in the cluster, every render generates a new password
+	var passwords []string
+	for i := 0; i < 2; i++ {
+		out, err := renderWithSecrets(t, "core", values)
+		if err != nil {
+			t.Fatalf("Failed to render chart. error=%v\n", err)
+		}
+		secret := bootstrapSecret(t, out)
+		if secret == nil {
+			t.Fatalf("Bootstrap secret is not rendered\n")
+		}
+		password := string(secret.Data["bootstrapPassword"])
+		if len(password) != 18 {
+			t.Errorf("Generated password is wrong. password=%v\n", password)
+		}
+		passwords = append(passwords, password)
+	}
+	if passwords[0] == passwords[1] {
+		t.Errorf("Generated passwords should be random. passwords=%v\n", passwords)
+	}
+
+	// once installed, upgrades render the password of the secret
+	installed := existingSecret("neuvector-bootstrap-secret", "bootstrapPassword", passwords[0])
+	for i := 0; i < 2; i++ {
+		out, err := renderWithSecrets(t, "core", values, installed)
+		if err != nil {
+			t.Fatalf("Failed to render chart. error=%v\n", err)
+		}
+		if password := string(bootstrapSecret(t, out).Data["bootstrapPassword"]); password != passwords[0] {
+			t.Errorf("Generated password changed on upgrade. expected=%v actual=%v\n", passwords[0], password)
+		}
+	}
+}
+
+func TestBootstrapPasswordErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		values map[string]string
+		err    string
+	}{
+		{
+			name:   "unknown key",
+			values: map[string]string{"bootstrapPassword.secret": "admin-password"},
+			err:    "/bootstrapPassword",
+		},
+	}
+
+	for _, c := range cases {
+		_, err := renderWithSecrets(t, "core", c.values)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: unexpected error. expected=%v actual=%v\n", c.name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// cleanupCall matches the API calls of the cleanup script: delete <path> and kube <method> <path>.
+var cleanupCall = regexp.MustCompile(`(?m)(?:^\s*(delete)|\bkube (GET|PATCH)) "?(/[^\s"?]+)`)
+
+// cleanupPermission returns the permission an API call of the cleanup script needs. The shell
+// variables are replaced by the release namespace and, for the loop over every namespace, by
+// another one.
+func cleanupPermission(t *testing.T, method string, path string) rbacPermission {
+	path = strings.ReplaceAll(strings.ReplaceAll(path, "$ns", "default"), "$n", "other")
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	var p rbacPermission
+	if parts[0] == "api" {
+		parts = parts[2:]
+	} else {
+		p.apiGroup = parts[1]
+		parts = parts[3:]
+	}
+	if len(parts) > 2 && parts[0] == "namespaces" {
+		p.namespace = parts[1]
+		parts = parts[2:]
+	}
+	p.resource = parts[0]
+	if len(parts) > 1 {
+		p.resourceName = parts[1]
+	}
+	if len(parts) > 2 {
+		p.resource += "/" + parts[2]
+	}
+
+	switch {
+	case method == "delete" && p.resourceName != "":
+		p.verb = "delete"
+	case method == "delete":
+		p.verb = "deletecollection"
+	case method == "GET" && p.resourceName == "":
+		p.verb = "list"
+	case method == "PATCH":
+		p.verb = "patch"
+	default:
+		t.Fatalf("Unexpected API call in the cleanup script. method=%v path=%v\n", method, path)
+	}
+	return p
+}
+
+func TestCleanupDisabled(t *testing.T) {
+	options := &helm.Options{
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+	for name := range objs {
+		if strings.Contains(name, "cleanup") {
+			t.Errorf("%s should not be rendered\n", name)
+		}
+	}
+}
+
+func TestCleanupHook(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"cleanup.enabled":               "true",
+			"cleanup.timeout":               "120",
+			"cleanup.resources.limits.cpu":  "100m",
+			"registry":                      "registry.example.com",
+			"cve.updater.image.tag":         "0.0.14",
+			"cleanup.nodeSelector.nodetype": "system",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+
+	for _, name := range []string{
+		"ServiceAccount/neuvector-cleanup",
+		"ClusterRole/neuvector-binding-cleanup",
+		"ClusterRoleBinding/neuvector-binding-cleanup",
+		"Role/neuvector-binding-cleanup",
+		"RoleBinding/neuvector-binding-cleanup",
+	} {
+		var obj namedObject
+		helm.UnmarshalK8SYaml(t, objs[name], &obj)
+		// the RBAC must exist when the pre-delete hook runs, so it is not a hook itself
+		if _, ok := obj.Annotations["helm.sh/hook"]; ok || obj.Name == "" {
+			t.Errorf("%s should be rendered as a release object\n", name)
+		}
+	}
+
+	var job batchv1.Job
+	helm.UnmarshalK8SYaml(t, objs["Job/neuvector-cleanup-pod"], &job)
+	if job.Annotations["helm.sh/hook"] != "pre-delete" {
+		t.Errorf("Cleanup job is not a pre-delete hook. annotations=%v\n", job.Annotations)
+	}
+	if job.Annotations["helm.sh/hook-delete-policy"] != "before-hook-creation,hook-succeeded" {
+		t.Errorf("Cleanup job delete policy is wrong. annotations=%v\n", job.Annotations)
+	}
+	if *job.Spec.ActiveDeadlineSeconds != 120 {
+		t.Errorf("Cleanup job deadline is wrong. activeDeadlineSeconds=%v\n", *job.Spec.ActiveDeadlineSeconds)
+	}
+	spec := job.Spec.Template.Spec
+	if spec.ServiceAccountName != "neuvector-cleanup" || spec.NodeSelector["nodetype"] != "system" || spec.RestartPolicy != "Never" {
+		t.Errorf("Cleanup pod spec is wrong. spec=%+v\n", spec)
+	}
+	c := spec.Containers[0]
+	if c.Image != "registry.example.com/neuvector/updater:0.0.14" {
+		t.Errorf("Cleanup image is wrong. image=%v\n", c.Image)
+	}
+	if c.Resources.Limits.Cpu().String() != "100m" {
+		t.Errorf("Cleanup resources are wrong. resources=%+v\n", c.Resources)
+	}
+	script := c.Command[len(c.Command)-1]
+	for _, line := range []string{
+		"kube PATCH /apis/apps/v1/namespaces/$ns/deployments/neuvector-controller-pod/scale",
+		"delete /apis/admissionregistration.k8s.io/v1/validatingwebhookconfigurations/neuvector-validating-admission-webhook",
+		"delete /apis/admissionregistration.k8s.io/v1/validatingwebhookconfigurations/neuvector-validating-crd-webhook",
+		"delete /api/v1/namespaces/$ns/secrets/neuvector-internal-certs",
+		"delete /apis/coordination.k8s.io/v1/namespaces/$ns/leases/neuvector-cert-upgrader",
+		"delete /apis/coordination.k8s.io/v1/namespaces/$ns/leases/neuvector-controller",
+	} {
+		if !strings.Contains(script, line) {
+			t.Errorf("Cleanup script is missing %q\n%s", line, script)
+		}
+	}
+	if strings.Contains(script, "neuvector.com") {
+		t.Errorf("Cleanup script should not delete the custom resources\n%s", script)
+	}
+}
+
+// TestCleanupRBAC checks that the cleanup service account is granted every API call of the
+// script and nothing the script does not use.
+func TestCleanupRBAC(t *testing.T) {
+	cases := []struct {
+		name   string
+		values map[string]string
+		calls  int
+	}{
+		{"default", map[string]string{}, 7},
+		{"custom resources", map[string]string{"cleanup.customResources": "true"}, 17},
+		{"least privilege", map[string]string{"leastPrivilege": "true"}, 7},
+		{"no controller", map[string]string{"controller.enabled": "false"}, 5},
+		{"no internal certificate", map[string]string{"internal.autoGenerateCert": "false"}, 4},
+		{"webhooks only", map[string]string{"controller.enabled": "false", "internal.autoGenerateCert": "false"}, 2},
+		{"fullname", map[string]string{"fullnameOverride": "nv"}, 7},
+		{"chart-managed admission webhook", map[string]string{"admissionwebhook.configuration.enabled": "true"}, 7},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: mergeValues(map[string]string{"cleanup.enabled": "true"}, c.values),
+			Logger:    logger.Discard,
+		}
+		out := helm.RenderTemplate(t, options, "../charts/core", nvRel, []string{})
+		objs, _ := renderObjects(t, "../charts/core", options)
+
+		sa := "neuvector-cleanup"
+		if c.values["fullnameOverride"] != "" {
+			sa = c.values["fullnameOverride"] + "-cleanup"
+		}
+		var job batchv1.Job
+		helm.UnmarshalK8SYaml(t, objs["Job/"+strings.TrimSuffix(sa, "-cleanup")+"-cleanup-pod"], &job)
+		script := job.Spec.Template.Spec.Containers[0].Command[2]
+
+		var calls []rbacPermission
+		for _, m := range cleanupCall.FindAllStringSubmatch(script, -1) {
+			calls = append(calls, cleanupPermission(t, m[1]+m[2], m[3]))
+		}
+		if len(calls) != c.calls {
+			t.Errorf("%s: unexpected API calls. calls=%v\n", c.name, calls)
+		}
+
+		matrix := buildRBACMatrix(t, out, "default")
+		grants := matrix["default:"+sa]
+		var granted []rbacPermission
+		for i := range grants {
+			if !strings.HasSuffix(grants[i].role, "-binding-cleanup") {
+				t.Errorf("%s: %s is bound to %s\n", c.name, sa, grants[i].role)
+			}
+			granted = append(granted, grants[i].permissions()...)
+		}
+		for _, call := range calls {
+			covered := false
+			for _, p := range granted {
+				covered = covered || p.covers(call)
+			}
+			if !covered {
+				t.Errorf("%s: %s is not granted %s\n", c.name, sa, call.String())
+			}
+		}
+		for _, p := range granted {
+			used := false
+			for _, call := range calls {
+				used = used || p.covers(call)
+			}
+			if !used {
+				t.Errorf("%s: %s is granted %s, which the script does not use\n", c.name, sa, p.String())
+			}
+		}
+
+		// the other service accounts gain nothing from the cleanup roles
+		for account, grants := range matrix {
+			for _, g := range grants {
+				if account != "default:"+sa && strings.HasSuffix(g.role, "-binding-cleanup") {
+					t.Errorf("%s: %s is bound to %s\n", c.name, account, g.role)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// imageCharts are the charts that run containers. The crd chart only holds definitions.
+var imageCharts = []string{"core", "monitor"}
+
+// chartImage is a container of a rendered chart. Init is set for init and ephemeral containers.
+type chartImage struct {
+	Chart     string
+	Template  string
+	Container string
+	Init      bool
+	Image     string
+}
+
+// workload holds the pod specs of any kind of workload: a Pod, the pod template of a Deployment,
+// DaemonSet, StatefulSet or Job, and the job template of a CronJob.
+type workload struct {
+	Spec struct {
+		corev1.PodSpec
+		Template    corev1.PodTemplateSpec  `json:"template"`
+		JobTemplate batchv1.JobTemplateSpec `json:"jobTemplate"`
+	} `json:"spec"`
+}
+
+func (w *workload) podSpecs() []corev1.PodSpec {
+	return []corev1.PodSpec{w.Spec.PodSpec, w.Spec.Template.Spec, w.Spec.JobTemplate.Spec.Template.Spec}
+}
+
+var documentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+func readValues(path string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if path == "" {
+		return values, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := k8syaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// renderChart renders the templates of a chart the way helm template does, without a cluster to
+// look up. The manifests are keyed by template name.
+func renderChart(dir string, values map[string]interface{}) (map[string]string, error) {
+	chrt, err := loader.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	options := chartutil.ReleaseOptions{Name: "neuvector", Namespace: "neuvector", IsInstall: true}
+	vals, err := chartutil.ToRenderValues(chrt, values, options, chartutil.DefaultCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	return engine.Render(chrt, vals)
+}
+
+// extractImages returns the images of the containers, init containers and ephemeral containers of
+// the rendered manifests.
+func extractImages(chart string, manifests map[string]string) ([]chartImage, error) {
+	var images []chartImage
+	for template, manifest := range manifests {
+		if !strings.HasSuffix(template, ".yaml") {
+			continue
+		}
+		for _, doc := range documentSeparator.Split(manifest, -1) {
+			if strings.TrimSpace(doc) == "" {
+				continue
+			}
+			var w workload
+			if err := k8syaml.Unmarshal([]byte(doc), &w); err != nil {
+				return nil, fmt.Errorf("%s: %w", template, err)
+			}
+			for _, spec := range w.podSpecs() {
+				for _, c := range spec.Containers {
+					images = append(images, chartImage{Chart: chart, Template: template, Container: c.Name, Image: c.Image})
+				}
+				for _, c := range spec.InitContainers {
+					images = append(images, chartImage{Chart: chart, Template: template, Container: c.Name, Init: true, Image: c.Image})
+				}
+				for _, c := range spec.EphemeralContainers {
+					images = append(images, chartImage{Chart: chart, Template: template, Container: c.Name, Init: true, Image: c.Image})
+				}
+			}
+		}
+	}
+	// the containers of an image come before its init containers, which usually run a command of
+	// the same image
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Image != images[j].Image {
+			return images[i].Image < images[j].Image
+		}
+		if images[i].Init != images[j].Init {
+			return !images[i].Init
+		}
+		return images[i].Container < images[j].Container
+	})
+	return images, nil
+}
+
+// imageReference splits an image into its registry, repository and tag or digest, with the
+// defaults of docker: docker.io and latest.
+func imageReference(image string) (registry string, repository string, version string) {
+	registry = "docker.io"
+	repository = image
+	if i := strings.Index(image, "/"); i > 0 {
+		host := image[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			registry = host
+			repository = image[i+1:]
+		}
+	}
+	version = "latest"
+	if i := strings.Index(repository, "@"); i > 0 {
+		version = repository[i+1:]
+		repository = repository[:i]
+	} else if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		version = repository[i+1:]
+		repository = repository[:i]
+	}
+	if registry == "docker.io" && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return registry, repository, version
+}
+
+func imagesText(images []chartImage) []byte {
+	seen := make(map[string]bool)
+	var list []string
+	for _, img := range images {
+		if !seen[img.Image] {
+			seen[img.Image] = true
+			list = append(list, img.Image)
+		}
+	}
+	sort.Strings(list)
+	return []byte(strings.Join(list, "\n") + "\n")
+}
+
+func marshal(v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	enc.Encode(v)
+	enc.Close()
+	return buf.Bytes()
+}
+
+type skopeoRegistry struct {
+	Images map[string][]string `yaml:"images"`
+}
+
+// skopeoSync returns the images in the YAML source format of skopeo sync.
+func skopeoSync(images []chartImage) []byte {
+	registries := make(map[string]*skopeoRegistry)
+	for _, img := range images {
+		registry, repository, version := imageReference(img.Image)
+		r, ok := registries[registry]
+		if !ok {
+			r = &skopeoRegistry{Images: make(map[string][]string)}
+			registries[registry] = r
+		}
+		versions := r.Images[repository]
+		found := false
+		for _, v := range versions {
+			found = found || v == version
+		}
+		if !found {
+			r.Images[repository] = append(versions, version)
+		}
+	}
+	return marshal(registries)
+}
+
+type artifactHubImage struct {
+	Name  string `yaml:"name"`
+	Image string `yaml:"image"`
+}
+
+// artifactHub returns the artifacthub.io/images annotation of a chart, to paste in Chart.yaml.
+func artifactHub(images []chartImage, chart string) []byte {
+	seen := make(map[string]bool)
+	var list []artifactHubImage
+	for _, img := range images {
+		if img.Chart != chart || seen[img.Image] {
+			continue
+		}
+		seen[img.Image] = true
+		list = append(list, artifactHubImage{Name: img.Container, Image: img.Image})
+	}
+	return marshal(map[string]map[string]string{
+		"annotations": {"artifacthub.io/images": string(marshal(list))},
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// imageLine matches the image of a container in a rendered manifest, whatever the kind of the
+// object holding it.
+var imageLine = regexp.MustCompile(`(?m)^\s*(?:-\s+)?image:\s*["']?([^"'\s]+)["']?\s*$`)
+
+// imageScenarios are the values the charts are rendered with to find every image: the snapshot
+// fixtures, and the components and image settings they leave out.
+func imageScenarios(t *testing.T) map[string]map[string]map[string]interface{} {
+	scenarios := make(map[string]map[string]map[string]interface{})
+
+	paths, err := filepath.Glob("../../fixtures/*.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No fixtures found. error=%v\n", err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read fixture. file=%v error=%v\n", path, err)
+		}
+		var fixture struct {
+			Core    map[string]interface{} `json:"core"`
+			Monitor map[string]interface{} `json:"monitor"`
+		}
+		if err := k8syaml.Unmarshal(data, &fixture); err != nil {
+			t.Fatalf("Failed to parse fixture. file=%v error=%v\n", path, err)
+		}
+		scenarios[filepath.Base(path)] = map[string]map[string]interface{}{"core": fixture.Core, "monitor": fixture.Monitor}
+	}
+
+	extra := map[string]string{
+		"gcp": `
+global:
+  gcp:
+    enabled: true
+    serviceAccountEmail: csp-adapter@my-project.iam.gserviceaccount.com
+    reportingSecret: neuvector-reporting
+    image:
+      digest: sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+`,
+		"adapter": `
+registry: registry.example.com:5000
+cve:
+  adapter:
+    enabled: true
+    image:
+      hash: sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+  scanner:
+    image:
+      registry: scanner.example.com
+  updater:
+    image:
+      registry: updater.example.com
+`,
+		"oem": `
+registry: registry.neuvector.com
+oem: acme
+`,
+	}
+	for name, values := range extra {
+		var core map[string]interface{}
+		if err := k8syaml.Unmarshal([]byte(values), &core); err != nil {
+			t.Fatalf("Failed to parse values. scenario=%v error=%v\n", name, err)
+		}
+		scenarios[name] = map[string]map[string]interface{}{"core": core}
+	}
+	return scenarios
+}
+
+// TestImagesFound fails when a template runs an image the generator does not find, or when no
+// scenario renders a template that holds images.
+func TestImagesFound(t *testing.T) {
+	rendered := make(map[string]bool)
+
+	for name, scenario := range imageScenarios(t) {
+		for _, chart := range imageCharts {
+			values := scenario[chart]
+			if values == nil {
+				values = make(map[string]interface{})
+			}
+			manifests, err := renderChart("../../../charts/"+chart, values)
+			if err != nil {
+				t.Fatalf("%s: failed to render the %s chart. error=%v\n", name, chart, err)
+			}
+			images, err := extractImages(chart, manifests)
+			if err != nil {
+				t.Fatalf("%s: failed to extract images. error=%v\n", name, err)
+			}
+
+			found := make(map[string]map[string]bool)
+			for _, img := range images {
+				if found[img.Template] == nil {
+					found[img.Template] = make(map[string]bool)
+				}
+				found[img.Template][img.Image] = true
+				rendered[img.Template] = true
+			}
+			for template, manifest := range manifests {
+				for _, m := range imageLine.FindAllStringSubmatch(manifest, -1) {
+					if !found[template][m[1]] {
+						t.Errorf("%s: image %s of %s is not found\n", name, m[1], template)
+					}
+				}
+			}
+		}
+	}
+
+	for _, chart := range imageCharts {
+		paths, _ := filepath.Glob(filepath.Join("../../../charts", chart, "templates", "*.yaml"))
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read template. file=%v error=%v\n", path, err)
+			}
+			template := chart + "/templates/" + filepath.Base(path)
+			if imageLine.Match(data) && !rendered[template] {
+				t.Errorf("No image of %s is found, add a scenario that renders it\n", template)
+			}
+		}
+	}
+}
+
+func TestImageReference(t *testing.T) {
+	cases := []struct {
+		image      string
+		registry   string
+		repository string
+		version    string
+	}{
+		{"docker.io/neuvector/controller:5.6.0", "docker.io", "neuvector/controller", "5.6.0"},
+		{"neuvector/manager:5.6.0", "docker.io", "neuvector/manager", "5.6.0"},
+		{"busybox", "docker.io", "library/busybox", "latest"},
+		{"registry.example.com:5000/neuvector/scanner", "registry.example.com:5000", "neuvector/scanner", "latest"},
+		{"localhost/neuvector/updater:0.0.13", "localhost", "neuvector/updater", "0.0.13"},
+		{"registry.example.com/neuvector/csp-adapter@sha256:0123", "registry.example.com", "neuvector/csp-adapter", "sha256:0123"},
+	}
+
+	for _, c := range cases {
+		registry, repository, version := imageReference(c.image)
+		if registry != c.registry || repository != c.repository || version != c.version {
+			t.Errorf("%s: reference is wrong. registry=%v repository=%v version=%v\n", c.image, registry, repository, version)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	coreValues := filepath.Join(dir, "core.yaml")
+	monitorValues := filepath.Join(dir, "monitor.yaml")
+	if err := os.WriteFile(coreValues, []byte("registry: registry.example.com\ntag: 5.6.1\nmanager:\n  enabled: false\ngitops:\n  enabled: true\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %s. error=%v\n", coreValues, err)
+	}
+	if err := os.WriteFile(monitorValues, []byte("registry: registry.example.com\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %s. error=%v\n", monitorValues, err)
+	}
+
+	output := filepath.Join(dir, "out")
+	if err := run("../../../charts", map[string]string{"core": coreValues, "monitor": monitorValues}, output); err != nil {
+		t.Fatalf("Failed to list images. error=%v\n", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(output, "images.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read images.txt. error=%v\n", err)
+	}
+	images := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, image := range []string{
+		"registry.example.com/neuvector/controller:5.6.1",
+		"registry.example.com/neuvector/enforcer:5.6.1",
+		"registry.example.com/neuvector/prometheus-exporter:1.0.16",
+		"registry.example.com/bci/bci-base:15.6",
+	} {
+		if !strings.Contains(string(data), image+"\n") {
+			t.Errorf("images.txt is missing %s.\n%s", image, data)
+		}
+	}
+	for _, image := range images {
+		if strings.Contains(image, "manager") || !strings.HasPrefix(image, "registry.example.com/") {
+			t.Errorf("images.txt has an unexpected image %s.\n%s", image, data)
+		}
+	}
+
+	var sync map[string]struct {
+		Images map[string][]string `yaml:"images"`
+	}
+	data, err = os.ReadFile(filepath.Join(output, "skopeo.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to read skopeo.yaml. error=%v\n", err)
+	}
+	if err := yaml.Unmarshal(data, &sync); err != nil {
+		t.Fatalf("Failed to parse skopeo.yaml. error=%v\n", err)
+	}
+	if versions := sync["registry.example.com"].Images["neuvector/controller"]; len(versions) != 1 || versions[0] != "5.6.1" {
+		t.Errorf("skopeo.yaml is wrong.\n%s", data)
+	}
+
+	var chart struct {
+		Annotations map[string]string `yaml:"annotations"`
+	}
+	data, err = os.ReadFile(filepath.Join(output, "artifacthub-monitor.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to read artifacthub-monitor.yaml. error=%v\n", err)
+	}
+	if err := yaml.Unmarshal(data, &chart); err != nil {
+		t.Fatalf("Failed to parse artifacthub-monitor.yaml. error=%v\n", err)
+	}
+	var list []artifactHubImage
+	if err := yaml.Unmarshal([]byte(chart.Annotations["artifacthub.io/images"]), &list); err != nil {
+		t.Fatalf("Failed to parse the artifacthub.io/images annotation. error=%v\n", err)
+	}
+	if len(list) != 1 || list[0].Image != "registry.example.com/neuvector/prometheus-exporter:1.0.16" {
+		t.Errorf("artifacthub.io/images is wrong. images=%+v\n", list)
+	}
+}
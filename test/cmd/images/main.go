@@ -0,0 +1,65 @@
+// Command images renders the core and monitor charts with the given values files and lists the
+// container images they run, for mirroring to the registry of a disconnected site. It writes
+// images.txt, a skopeo sync file and the artifacthub.io/images annotation of each chart.
+//
+//	go run ./cmd/images -f core-values.yaml -monitor monitor-values.yaml -o images
+//	skopeo sync --src yaml --dest docker images/skopeo.yaml registry.example.com
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	charts := flag.String("charts", "../charts", "directory of the charts")
+	coreValues := flag.String("f", "", "values file of the core chart")
+	monitorValues := flag.String("monitor", "", "values file of the monitor chart")
+	output := flag.String("o", ".", "directory to write the image lists to")
+	flag.Parse()
+
+	if err := run(*charts, map[string]string{"core": *coreValues, "monitor": *monitorValues}, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list images: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run renders each chart with its values file, an empty name for the chart defaults, and writes
+// the image lists to the output directory.
+func run(charts string, valuesFiles map[string]string, output string) error {
+	var images []chartImage
+	for _, chart := range imageCharts {
+		values, err := readValues(valuesFiles[chart])
+		if err != nil {
+			return fmt.Errorf("%s values: %w", chart, err)
+		}
+		manifests, err := renderChart(filepath.Join(charts, chart), values)
+		if err != nil {
+			return fmt.Errorf("%s chart: %w", chart, err)
+		}
+		found, err := extractImages(chart, manifests)
+		if err != nil {
+			return fmt.Errorf("%s chart: %w", chart, err)
+		}
+		images = append(images, found...)
+	}
+
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return err
+	}
+	files := map[string][]byte{
+		"images.txt":  imagesText(images),
+		"skopeo.yaml": skopeoSync(images),
+	}
+	for _, chart := range imageCharts {
+		files["artifacthub-"+chart+".yaml"] = artifactHub(images, chart)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(output, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Command migrate-values rewrites the deprecated keys of a values file of the core or the
+// monitor chart into their current equivalents, and reports the keys it cannot migrate.
+//
+//	go run ./cmd/migrate-values -f my-values.yaml -o my-values.yaml
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+func main() {
+	input := flag.String("f", "-", "values file to migrate, - for stdin")
+	output := flag.String("o", "-", "file to write the migrated values to, - for stdout")
+	flag.Parse()
+
+	manual, err := run(*input, *output, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to migrate values: %v\n", err)
+		os.Exit(1)
+	}
+	if manual {
+		os.Exit(2)
+	}
+}
+
+// run migrates the input file and prints the findings to report. It returns true when some
+// keys need to be migrated by hand.
+func run(input string, output string, report io.Writer) (bool, error) {
+	var data []byte
+	var err error
+	if input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(input)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false, err
+	}
+	findings, err := migrate(&doc)
+	if err != nil {
+		return false, err
+	}
+
+	var buf bytes.Buffer
+	if doc.Kind != 0 {
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return false, err
+		}
+		enc.Close()
+	}
+
+	if output == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = os.WriteFile(output, buf.Bytes(), 0644)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	manual := false
+	for _, f := range findings {
+		fmt.Fprintln(report, f.String())
+		if !f.Migrated {
+			manual = true
+		}
+	}
+	return manual, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// finding is a deprecated key found in the values. Migrated is false when the key is left in
+// place and needs to be changed by hand.
+type finding struct {
+	Key      string
+	Message  string
+	Migrated bool
+}
+
+func (f finding) String() string {
+	if f.Migrated {
+		return fmt.Sprintf("migrated: %s: %s", f.Key, f.Message)
+	}
+	return fmt.Sprintf("manual: %s: %s", f.Key, f.Message)
+}
+
+type migrator struct {
+	root     *yaml.Node
+	findings []finding
+}
+
+func (m *migrator) migrated(key string, format string, args ...interface{}) {
+	m.findings = append(m.findings, finding{Key: key, Message: fmt.Sprintf(format, args...), Migrated: true})
+}
+
+func (m *migrator) manual(key string, format string, args ...interface{}) {
+	m.findings = append(m.findings, finding{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// migrations rewrite the deprecated keys. The keys of the core and the monitor charts do not
+// overlap, so every migration runs on any values file.
+var migrations = []func(m *migrator){
+	migrateRuntime,           // docker, k3s, bottlerocket, containerd, crio
+	migrateImagePullSecrets,  // imagePullSecrets
+	migrateBootstrapPassword, // bootstrapPassword
+	migrateCtrlSecretName,    // exporter.ctrlSercretName
+}
+
+// legacyRuntime is a runtime block deprecated by runtimePath, in the order the enforcer
+// template checks them.
+type legacyRuntime struct {
+	name        string
+	pathKey     string
+	defaultPath string
+}
+
+var legacyRuntimes = []legacyRuntime{
+	{"k3s", "runtimePath", "/run/k3s/containerd/containerd.sock"},
+	{"bottlerocket", "runtimePath", "/run/dockershim.sock"},
+	{"containerd", "path", "/var/run/containerd/containerd.sock"},
+	{"crio", "path", "/var/run/crio/crio.sock"},
+	{"docker", "path", "/var/run/docker.sock"},
+}
+
+var semverTag = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)`)
+
+// pre530 reports if the image tag is older than 5.2.10, which still mounts the runtime
+// socket selected by the legacy runtime blocks.
+func pre530(tag string) bool {
+	match := semverTag.FindStringSubmatch(tag)
+	if match == nil {
+		return false
+	}
+	var v [3]int
+	for i := range v {
+		v[i], _ = strconv.Atoi(match[i+1])
+	}
+	if v[0] != 5 {
+		return v[0] < 5
+	}
+	if v[1] != 2 {
+		return v[1] < 2
+	}
+	return v[2] < 10
+}
+
+func migrateRuntime(m *migrator) {
+	var present []legacyRuntime
+	for _, rt := range legacyRuntimes {
+		if lookup(m.root, rt.name) != nil {
+			present = append(present, rt)
+		}
+	}
+	if len(present) == 0 {
+		return
+	}
+
+	if tag := lookup(m.root, "tag"); tag != nil && pre530(tag.Value) {
+		for _, rt := range present {
+			m.manual(rt.name, "tag %s selects the runtime socket with this key, keep it until upgrading to 5.3.0 or later", tag.Value)
+		}
+		return
+	}
+
+	var enabled []legacyRuntime
+	for _, rt := range present {
+		if rt.name == "docker" {
+			continue
+		}
+		if e := lookup(m.root, rt.name, "enabled"); e != nil && e.Value == "true" {
+			enabled = append(enabled, rt)
+		}
+	}
+	if len(enabled) > 1 {
+		for _, rt := range enabled {
+			m.manual(rt.name+".enabled", "more than one runtime is enabled, set runtimePath to the socket of the node runtime")
+		}
+		return
+	}
+
+	// the socket at the default location of a runtime is detected, only other paths need runtimePath
+	var path, from string
+	if len(enabled) == 1 {
+		from = enabled[0].name + "." + enabled[0].pathKey
+		if p := lookup(m.root, enabled[0].name, enabled[0].pathKey); p != nil && p.Value != "" && p.Value != enabled[0].defaultPath {
+			path = p.Value
+		}
+	} else if p := lookup(m.root, "docker", "path"); p != nil && p.Value != "" && p.Value != "/var/run/docker.sock" {
+		from, path = "docker.path", p.Value
+	}
+
+	if path != "" {
+		if current := lookup(m.root, "runtimePath"); current != nil && current.Value != "" && current.Value != path {
+			m.manual(from, "runtimePath is already set to %s, check which socket is used on the nodes", current.Value)
+			return
+		}
+		set(m.root, "runtimePath", scalar(path))
+		m.migrated(from, "moved to runtimePath")
+	}
+
+	for _, rt := range present {
+		remove(m.root, rt.name)
+		if path == "" && len(enabled) == 1 && rt.name == enabled[0].name {
+			m.migrated(rt.name, "removed, the runtime socket at the default location is detected")
+		} else {
+			m.migrated(rt.name, "removed")
+		}
+	}
+}
+
+func migrateImagePullSecrets(m *migrator) {
+	node := lookup(m.root, "imagePullSecrets")
+	if node == nil || node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		return
+	}
+
+	list := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	if node.Value != "" {
+		item := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		set(item, "name", scalar(node.Value))
+		list.Content = append(list.Content, item)
+	} else {
+		list.Style = yaml.FlowStyle
+	}
+	set(m.root, "imagePullSecrets", list)
+	m.migrated("imagePullSecrets", "converted to a list")
+}
+
+func migrateBootstrapPassword(m *migrator) {
+	node := lookup(m.root, "bootstrapPassword")
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return
+	}
+
+	if node.Value == "" || node.Tag == "!!null" {
+		remove(m.root, "bootstrapPassword")
+		m.migrated("bootstrapPassword", "removed, no bootstrap password is the default")
+		return
+	}
+	password := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	set(password, "value", scalar(node.Value))
+	set(m.root, "bootstrapPassword", password)
+	m.migrated("bootstrapPassword", "moved to bootstrapPassword.value")
+}
+
+func migrateCtrlSecretName(m *migrator) {
+	exporter := lookup(m.root, "exporter")
+	typo := lookup(m.root, "exporter", "ctrlSercretName")
+	if typo == nil {
+		return
+	}
+
+	if typo.Value != "" && typo.Tag != "!!null" {
+		if current := lookup(exporter, "ctrlSecretName"); current != nil && current.Value != "" && current.Value != typo.Value {
+			m.manual("exporter.ctrlSercretName", "exporter.ctrlSecretName is already set to %s, the misspelled key was ignored by the chart", current.Value)
+			return
+		}
+		set(exporter, "ctrlSecretName", scalar(typo.Value))
+		remove(exporter, "ctrlSercretName")
+		m.migrated("exporter.ctrlSercretName", "renamed to exporter.ctrlSecretName, the misspelled key was ignored by the chart")
+		return
+	}
+	remove(exporter, "ctrlSercretName")
+	m.migrated("exporter.ctrlSercretName", "removed")
+}
+
+// migrate rewrites the deprecated keys of a values document in place.
+func migrate(doc *yaml.Node) ([]finding, error) {
+	root := doc
+	if root.Kind == yaml.DocumentNode {
+		if len(root.Content) == 0 {
+			return nil, nil
+		}
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("values must be a mapping")
+	}
+
+	m := &migrator{root: root}
+	for _, fn := range migrations {
+		fn(m)
+	}
+	return m.findings, nil
+}
+
+// lookup returns the value of a key path in a mapping, or nil.
+func lookup(node *yaml.Node, keys ...string) *yaml.Node {
+	for _, key := range keys {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+// set replaces the value of a key in a mapping, or appends the key.
+func set(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, scalar(key), value)
+}
+
+func remove(node *yaml.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+func scalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func migrateString(t *testing.T, values string) (string, []finding) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(values), &doc); err != nil {
+		t.Fatalf("Failed to parse values. error=%v\n", err)
+	}
+	findings, err := migrate(&doc)
+	if err != nil {
+		t.Fatalf("Failed to migrate values. error=%v\n", err)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		t.Fatalf("Failed to encode values. error=%v\n", err)
+	}
+	enc.Close()
+	return buf.String(), findings
+}
+
+func TestMigrations(t *testing.T) {
+	cases := []struct {
+		name     string
+		values   string
+		expected string
+		manual   []string
+	}{
+		{
+			name:     "current values",
+			values:   "runtimePath: /run/containerd/containerd.sock\nimagePullSecrets:\n  - name: regcred\n",
+			expected: "runtimePath: /run/containerd/containerd.sock\nimagePullSecrets:\n  - name: regcred\n",
+		},
+		{
+			name:     "default runtime blocks",
+			values:   "tag: 5.4.0\ndocker:\n  path: /var/run/docker.sock\nk3s:\n  enabled: false\n  runtimePath: /run/k3s/containerd/containerd.sock\n",
+			expected: "tag: 5.4.0\n",
+		},
+		{
+			name:     "k3s at the default location",
+			values:   "k3s:\n  enabled: true\n",
+			expected: "{}\n",
+		},
+		{
+			name:     "k3s at another location",
+			values:   "k3s:\n  enabled: true\n  runtimePath: /run/custom/containerd.sock\n",
+			expected: "runtimePath: /run/custom/containerd.sock\n",
+		},
+		{
+			name:     "bottlerocket",
+			values:   "bottlerocket:\n  enabled: true\n  runtimePath: /run/containerd/containerd.sock\n",
+			expected: "runtimePath: /run/containerd/containerd.sock\n",
+		},
+		{
+			name:     "containerd",
+			values:   "containerd:\n  enabled: true\n  path: /run/containerd/containerd.sock\n",
+			expected: "runtimePath: /run/containerd/containerd.sock\n",
+		},
+		{
+			name:     "crio",
+			values:   "crio:\n  enabled: true\n  path: /run/crio/crio.sock\n",
+			expected: "runtimePath: /run/crio/crio.sock\n",
+		},
+		{
+			name:     "docker",
+			values:   "docker:\n  path: /run/docker.sock\n",
+			expected: "runtimePath: /run/docker.sock\n",
+		},
+		{
+			name:     "runtime path of a disabled runtime",
+			values:   "crio:\n  enabled: false\n  path: /run/crio/crio.sock\n",
+			expected: "{}\n",
+		},
+		{
+			name:     "runtimePath already set to the same socket",
+			values:   "runtimePath: /run/crio/crio.sock\ncrio:\n  enabled: true\n  path: /run/crio/crio.sock\n",
+			expected: "runtimePath: /run/crio/crio.sock\n",
+		},
+		{
+			name:     "runtimePath already set to another socket",
+			values:   "runtimePath: /run/containerd/containerd.sock\ncrio:\n  enabled: true\n  path: /run/crio/crio.sock\n",
+			expected: "runtimePath: /run/containerd/containerd.sock\ncrio:\n  enabled: true\n  path: /run/crio/crio.sock\n",
+			manual:   []string{"crio.path"},
+		},
+		{
+			name:     "several runtimes enabled",
+			values:   "k3s:\n  enabled: true\ncontainerd:\n  enabled: true\n",
+			expected: "k3s:\n  enabled: true\ncontainerd:\n  enabled: true\n",
+			manual:   []string{"k3s.enabled", "containerd.enabled"},
+		},
+		{
+			name:     "tag before runtimePath",
+			values:   "tag: 5.2.4\ncontainerd:\n  enabled: true\n",
+			expected: "tag: 5.2.4\ncontainerd:\n  enabled: true\n",
+			manual:   []string{"containerd"},
+		},
+		{
+			name:     "single image pull secret",
+			values:   "imagePullSecrets: regcred\n",
+			expected: "imagePullSecrets:\n  - name: regcred\n",
+		},
+		{
+			name:     "empty image pull secret",
+			values:   "imagePullSecrets: \"\"\n",
+			expected: "imagePullSecrets: []\n",
+		},
+		{
+			name:     "no image pull secret",
+			values:   "imagePullSecrets:\n",
+			expected: "imagePullSecrets:\n",
+		},
+		{
+			name:     "bootstrap password",
+			values:   "bootstrapPassword: Admin-Password1\n",
+			expected: "bootstrapPassword:\n  value: Admin-Password1\n",
+		},
+		{
+			name:     "empty bootstrap password",
+			values:   "bootstrapPassword: \"\"\nautoGenerateCert: true\n",
+			expected: "autoGenerateCert: true\n",
+		},
+		{
+			name:     "bootstrap password object",
+			values:   "bootstrapPassword:\n  existingSecret: admin-password\n",
+			expected: "bootstrapPassword:\n  existingSecret: admin-password\n",
+		},
+		{
+			name:     "misspelled exporter secret",
+			values:   "exporter:\n  ctrlSercretName: ctrl-login\n",
+			expected: "exporter:\n  ctrlSecretName: ctrl-login\n",
+		},
+		{
+			name:     "empty misspelled exporter secret",
+			values:   "exporter:\n  ctrlSercretName: ''\n  ctrlSecretName: ctrl-login\n",
+			expected: "exporter:\n  ctrlSecretName: ctrl-login\n",
+		},
+		{
+			name:     "both exporter secrets",
+			values:   "exporter:\n  ctrlSercretName: old-login\n  ctrlSecretName: ctrl-login\n",
+			expected: "exporter:\n  ctrlSercretName: old-login\n  ctrlSecretName: ctrl-login\n",
+			manual:   []string{"exporter.ctrlSercretName"},
+		},
+		{
+			name:     "comments are kept",
+			values:   "# registry of the images\nregistry: docker.io\nimagePullSecrets: regcred # pull secret\n",
+			expected: "# registry of the images\nregistry: docker.io\nimagePullSecrets:\n  - name: regcred\n",
+		},
+	}
+
+	for _, c := range cases {
+		out, findings := migrateString(t, c.values)
+		if out != c.expected {
+			t.Errorf("%s: unexpected values.\nexpected:\n%s\nactual:\n%s", c.name, c.expected, out)
+		}
+
+		var manual []string
+		for _, f := range findings {
+			if !f.Migrated {
+				manual = append(manual, f.Key)
+			}
+		}
+		if strings.Join(manual, ",") != strings.Join(c.manual, ",") {
+			t.Errorf("%s: unexpected manual findings. expected=%v actual=%v\n", c.name, c.manual, manual)
+		}
+	}
+}
+
+func TestMigrateChartDefaults(t *testing.T) {
+	// the chart defaults still carry the deprecated keys, they migrate without manual steps
+	for _, chart := range []string{"core", "monitor"} {
+		data, err := os.ReadFile(filepath.Join("..", "..", "..", "charts", chart, "values.yaml"))
+		if err != nil {
+			t.Fatalf("Failed to read values.yaml. chart=%v error=%v\n", chart, err)
+		}
+		out, findings := migrateString(t, string(data))
+		for _, f := range findings {
+			if !f.Migrated {
+				t.Errorf("%s: default values need a manual migration. finding=%v\n", chart, f.String())
+			}
+		}
+
+		var migrated map[string]interface{}
+		if err := yaml.Unmarshal([]byte(out), &migrated); err != nil {
+			t.Fatalf("Failed to parse migrated values. chart=%v error=%v\n", chart, err)
+		}
+		for _, key := range []string{"docker", "k3s", "bottlerocket", "containerd", "crio"} {
+			if _, ok := migrated[key]; ok {
+				t.Errorf("%s: %s is not migrated\n", chart, key)
+			}
+		}
+		if exporter, ok := migrated["exporter"].(map[string]interface{}); ok {
+			if _, ok := exporter["ctrlSercretName"]; ok {
+				t.Errorf("%s: exporter.ctrlSercretName is not migrated\n", chart)
+			}
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(input, []byte("k3s:\n  enabled: true\n  runtimePath: /run/custom.sock\ncontainerd:\n  enabled: true\n"), 0644); err != nil {
+		t.Fatalf("Failed to write values. error=%v\n", err)
+	}
+
+	var report bytes.Buffer
+	manual, err := run(input, input, &report)
+	if err != nil {
+		t.Fatalf("Failed to run. error=%v\n", err)
+	}
+	if !manual || !strings.Contains(report.String(), "manual: k3s.enabled:") {
+		t.Errorf("Manual migration is not reported. report=%v\n", report.String())
+	}
+}
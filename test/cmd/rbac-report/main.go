@@ -0,0 +1,58 @@
+// Command rbac-report generates the RBAC permission report in the README of the core chart from
+// the roles and bindings the chart renders on Kubernetes and OpenShift, in the default and the
+// leastPrivilege mode.
+//
+//	go run ./cmd/rbac-report
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The report is generated between these markers of the README of the core chart.
+const (
+	reportBegin = "<!-- BEGIN RBAC REPORT -->"
+	reportEnd   = "<!-- END RBAC REPORT -->"
+)
+
+func main() {
+	charts := flag.String("charts", "../charts", "directory of the charts")
+	flag.Parse()
+
+	if err := updateReadme(filepath.Join(*charts, "core")); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate the RBAC report: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// readme returns the README of a chart and the offsets of the report between the markers.
+func readme(dir string) (string, int, int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "README.md"))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	text := string(data)
+	begin := strings.Index(text, reportBegin)
+	end := strings.Index(text, reportEnd)
+	if begin < 0 || end < begin {
+		return "", 0, 0, fmt.Errorf("RBAC report markers are missing from %s", filepath.Join(dir, "README.md"))
+	}
+	return text, begin + len(reportBegin), end, nil
+}
+
+func updateReadme(dir string) error {
+	text, begin, end, err := readme(dir)
+	if err != nil {
+		return err
+	}
+	report, err := chartReport(dir)
+	if err != nil {
+		return err
+	}
+	text = text[:begin] + report + text[end:]
+	return os.WriteFile(filepath.Join(dir, "README.md"), []byte(text), 0644)
+}
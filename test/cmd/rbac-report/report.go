@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"sigs.k8s.io/yaml"
+)
+
+type rule struct {
+	APIGroups       []string `json:"apiGroups"`
+	Resources       []string `json:"resources"`
+	ResourceNames   []string `json:"resourceNames"`
+	Verbs           []string `json:"verbs"`
+	NonResourceURLs []string `json:"nonResourceURLs"`
+}
+
+// rbacObject is a Role, ClusterRole or binding of either rbac.authorization.k8s.io or
+// authorization.openshift.io. OpenShift bindings may omit roleRef.kind and list the
+// service accounts in userNames as well as in subjects.
+type rbacObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Rules   []rule `json:"rules"`
+	RoleRef struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"roleRef"`
+	Subjects []struct {
+		Kind      string `json:"kind"`
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"subjects"`
+	UserNames []string `json:"userNames"`
+}
+
+// builtinRoles are the cluster roles the chart binds without rendering them. Their rules are not
+// listed in the report.
+var builtinRoles = map[string]bool{
+	"cluster-admin":                   true,
+	"admin":                           true,
+	"edit":                            true,
+	"view":                            true,
+	"system:openshift:scc:privileged": true,
+}
+
+// grant is a rule granted to a service account by a binding. Namespace is empty for cluster-wide
+// grants and the rule is empty for built-in roles.
+type grant struct {
+	account   string
+	namespace string
+	binding   string
+	role      string
+	builtin   bool
+	rule      rule
+}
+
+// platform is a cluster the chart is rendered for.
+type platform struct {
+	values      map[string]interface{}
+	apiVersions []string
+}
+
+var (
+	kubernetes = platform{}
+	openshift  = platform{
+		values:      map[string]interface{}{"openshift": true},
+		apiVersions: []string{"security.openshift.io/v1"},
+	}
+)
+
+var documentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// render renders the core chart the way helm template does, without a cluster to look up, and
+// returns the grants of its bindings.
+func (p platform) render(dir string, leastPrivilege bool) ([]grant, error) {
+	chrt, err := loader.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{"leastPrivilege": leastPrivilege}
+	for k, v := range p.values {
+		values[k] = v
+	}
+	caps := chartutil.DefaultCapabilities.Copy()
+	caps.APIVersions = append(caps.APIVersions, p.apiVersions...)
+	options := chartutil.ReleaseOptions{Name: "neuvector", Namespace: "neuvector", IsInstall: true}
+	vals, err := chartutil.ToRenderValues(chrt, values, options, caps)
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := engine.Render(chrt, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []string
+	for template, manifest := range manifests {
+		if strings.HasSuffix(template, ".yaml") {
+			docs = append(docs, documentSeparator.Split(manifest, -1)...)
+		}
+	}
+	return grants(docs, options.Namespace)
+}
+
+// grants resolves the bindings of the manifests to the rules of their roles.
+func grants(docs []string, namespace string) ([]grant, error) {
+	roles := make(map[string]*rbacObject)
+	var bindings []*rbacObject
+	for _, doc := range docs {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		var obj rbacObject
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return nil, err
+		}
+		if obj.Metadata.Namespace == "" {
+			obj.Metadata.Namespace = namespace
+		}
+		switch obj.Kind {
+		case "ClusterRole":
+			roles["ClusterRole/"+obj.Metadata.Name] = &obj
+		case "Role":
+			roles["Role/"+obj.Metadata.Namespace+"/"+obj.Metadata.Name] = &obj
+		case "ClusterRoleBinding", "RoleBinding":
+			bindings = append(bindings, &obj)
+		}
+	}
+
+	var result []grant
+	for _, b := range bindings {
+		ns := b.Metadata.Namespace
+		if b.Kind == "ClusterRoleBinding" {
+			ns = ""
+		}
+		binding := b.Kind + "/" + b.Metadata.Name
+
+		// OpenShift bindings without roleRef.kind: a role binding refers to the role of its
+		// namespace if there is one, anything else to a cluster role.
+		key := "ClusterRole/" + b.RoleRef.Name
+		if local := "Role/" + b.Metadata.Namespace + "/" + b.RoleRef.Name; b.Kind == "RoleBinding" &&
+			(b.RoleRef.Kind == "Role" || b.RoleRef.Kind == "" && roles[local] != nil) {
+			key = local
+		}
+
+		var rules []rule
+		builtin := false
+		if r, ok := roles[key]; ok {
+			rules = r.Rules
+		} else if strings.HasPrefix(key, "ClusterRole/") && builtinRoles[b.RoleRef.Name] {
+			rules, builtin = []rule{{}}, true
+		} else {
+			return nil, fmt.Errorf("%s refers to %s which is not rendered", binding, key)
+		}
+
+		accounts := make(map[string]bool)
+		for _, s := range b.Subjects {
+			if s.Kind == "ServiceAccount" {
+				accounts[s.Name] = true
+			}
+		}
+		for _, user := range b.UserNames {
+			if sa := strings.TrimPrefix(user, "system:serviceaccount:"); sa != user {
+				accounts[strings.SplitN(sa, ":", 2)[1]] = true
+			}
+		}
+		for account := range accounts {
+			for _, r := range rules {
+				result = append(result, grant{
+					account:   account,
+					namespace: ns,
+					binding:   binding,
+					role:      b.RoleRef.Name,
+					builtin:   builtin,
+					rule:      r,
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+// reportRows lists the grants as markdown table rows.
+func reportRows(grants []grant) []string {
+	var rows []string
+	seen := make(map[string]bool)
+	for _, g := range grants {
+		scope := "cluster"
+		if g.namespace != "" {
+			scope = "namespace"
+		}
+		var row string
+		if g.builtin {
+			row = fmt.Sprintf("`%s` | %s | built-in `%s` role | | | %s", g.account, scope, g.role, g.binding)
+		} else {
+			groups := make([]string, len(g.rule.APIGroups))
+			for i, group := range g.rule.APIGroups {
+				if group == "" {
+					group = "core"
+				}
+				groups[i] = group
+			}
+			resources := strings.Join(g.rule.Resources, ", ")
+			if len(g.rule.ResourceNames) > 0 {
+				resources += " (" + strings.Join(g.rule.ResourceNames, ", ") + ")"
+			}
+			row = fmt.Sprintf("`%s` | %s | %s | %s | %s | %s", g.account, scope, strings.Join(groups, ", "), resources,
+				strings.Join(g.rule.Verbs, ", "), g.binding)
+		}
+		if !seen[row] {
+			seen[row] = true
+			rows = append(rows, row)
+		}
+	}
+	sort.Strings(rows)
+	return rows
+}
+
+// chartReport generates the permission report of the chart, the OpenShift tables only list what
+// the chart does not grant on Kubernetes.
+func chartReport(dir string) (string, error) {
+	var b strings.Builder
+	header := "Service account | Scope | API groups | Resources | Verbs | Granted by\n" +
+		"----------------|-------|------------|-----------|-------|-----------\n"
+
+	for _, least := range []bool{false, true} {
+		title, desc := "Default", "All components run with the `serviceAccount` service account."
+		if least {
+			title, desc = "Least privilege", "With `leastPrivilege` set, each component runs with its own service account."
+		}
+
+		k8sGrants, err := kubernetes.render(dir, least)
+		if err != nil {
+			return "", err
+		}
+		k8s := reportRows(k8sGrants)
+		fmt.Fprintf(&b, "\n### %s\n\n%s Namespace scope is the release namespace.\n\n%s", title, desc, header)
+		inK8s := make(map[string]bool)
+		for _, row := range k8s {
+			b.WriteString(row + "\n")
+			inK8s[row] = true
+		}
+
+		ocpGrants, err := openshift.render(dir, least)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "\nOn OpenShift, the service accounts are also granted:\n\n%s", header)
+		for _, row := range reportRows(ocpGrants) {
+			if !inK8s[row] {
+				b.WriteString(row + "\n")
+			}
+		}
+	}
+	return b.String(), nil
+}
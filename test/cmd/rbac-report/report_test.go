@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadmeReport(t *testing.T) {
+	dir := filepath.Join("..", "..", "..", "charts", "core")
+	text, begin, end, err := readme(dir)
+	if err != nil {
+		t.Fatalf("Failed to read the README. error=%v\n", err)
+	}
+	report, err := chartReport(dir)
+	if err != nil {
+		t.Fatalf("Failed to generate the RBAC report. error=%v\n", err)
+	}
+
+	current := strings.Split(text[begin:end], "\n")
+	expected := strings.Split(report, "\n")
+	for i := 0; i < len(current) || i < len(expected); i++ {
+		var got, want string
+		if i < len(current) {
+			got = current[i]
+		}
+		if i < len(expected) {
+			want = expected[i]
+		}
+		if got != want {
+			t.Errorf("RBAC report of the core chart is out of date, run go run ./cmd/rbac-report to regenerate it.\nREADME:    %s\ngenerated: %s\n", got, want)
+			break
+		}
+	}
+}
+
+func TestReportRows(t *testing.T) {
+	docs := strings.Split(`
+apiVersion: authorization.openshift.io/v1
+kind: ClusterRole
+metadata:
+  name: test-app
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["get", "list"]
+---
+apiVersion: authorization.openshift.io/v1
+kind: Role
+metadata:
+  name: test-secret
+rules:
+- apiGroups: [""]
+  resources: ["secrets"]
+  resourceNames: ["test"]
+  verbs: ["get"]
+---
+apiVersion: authorization.openshift.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: test-app
+roleRef:
+  name: test-app
+subjects:
+- kind: ServiceAccount
+  name: controller
+  namespace: neuvector
+userNames:
+- system:serviceaccount:neuvector:enforcer
+---
+apiVersion: authorization.openshift.io/v1
+kind: RoleBinding
+metadata:
+  name: test-secret
+roleRef:
+  name: test-secret
+subjects:
+- kind: ServiceAccount
+  name: controller
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: test-view
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: view
+subjects:
+- kind: ServiceAccount
+  name: scanner`, "---")
+
+	g, err := grants(docs, "neuvector")
+	if err != nil {
+		t.Fatalf("Failed to resolve the grants. error=%v\n", err)
+	}
+	expected := []string{
+		"`controller` | cluster | core | pods | get, list | ClusterRoleBinding/test-app",
+		"`controller` | namespace | core | secrets (test) | get | RoleBinding/test-secret",
+		"`enforcer` | cluster | core | pods | get, list | ClusterRoleBinding/test-app",
+		"`scanner` | namespace | built-in `view` role | | | RoleBinding/test-view",
+	}
+	rows := reportRows(g)
+	if strings.Join(rows, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected rows.\n%s\nexpected:\n%s", strings.Join(rows, "\n"), strings.Join(expected, "\n"))
+	}
+
+	if _, err := grants([]string{"kind: RoleBinding\nmetadata:\n  name: test\nroleRef:\n  name: missing\n"}, "neuvector"); err == nil {
+		t.Errorf("Binding to a role that is not rendered should fail\n")
+	}
+}
@@ -0,0 +1,62 @@
+// Command values-table generates the configuration table in the README of each chart from its
+// values.yaml and values.schema.json. The descriptions and types come from the schema, the
+// defaults and the descriptions of the keys the schema does not describe from values.yaml.
+//
+//	go run ./cmd/values-table
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The table is generated between these markers of the README of each chart.
+const (
+	tableBegin = "<!-- BEGIN VALUES TABLE -->"
+	tableEnd   = "<!-- END VALUES TABLE -->"
+)
+
+var tableCharts = []string{"core", "crd", "monitor"}
+
+func main() {
+	charts := flag.String("charts", "../charts", "directory of the charts")
+	flag.Parse()
+
+	for _, chart := range tableCharts {
+		if err := updateReadme(filepath.Join(*charts, chart)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate the values table of the %s chart: %v\n", chart, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// readme returns the README of a chart and the offsets of the table between the markers.
+func readme(dir string) (string, int, int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "README.md"))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	text := string(data)
+	begin := strings.Index(text, tableBegin)
+	end := strings.Index(text, tableEnd)
+	if begin < 0 || end < begin {
+		return "", 0, 0, fmt.Errorf("values table markers are missing from %s", filepath.Join(dir, "README.md"))
+	}
+	return text, begin + len(tableBegin), end, nil
+}
+
+func updateReadme(dir string) error {
+	text, begin, end, err := readme(dir)
+	if err != nil {
+		return err
+	}
+	table, err := chartTable(dir)
+	if err != nil {
+		return err
+	}
+	text = text[:begin] + table + text[end:]
+	return os.WriteFile(filepath.Join(dir, "README.md"), []byte(text), 0644)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxDefault is the length of the longest default printed in the table, longer defaults refer to
+// values.yaml.
+const maxDefault = 60
+
+const longDefault = "see [values.yaml](values.yaml)"
+
+// documents are the values holding the content of an init configuration file, each a single
+// parameter. The init configuration section of the core chart README describes their keys.
+var documents = []string{"controller.initcfg.*", "controller.secret.data"}
+
+// schemaTypes is the type keyword of a schema, a type or a list of types.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*t = many
+	return nil
+}
+
+// schema is the part of values.schema.json the table is generated from.
+type schema struct {
+	Type        schemaTypes        `json:"type"`
+	Enum        []interface{}      `json:"enum"`
+	Description string             `json:"description"`
+	Properties  map[string]*schema `json:"properties"`
+}
+
+// row is a parameter of the table.
+type row struct {
+	Name        string
+	Type        string
+	Default     string
+	Description string
+}
+
+// commentedKey matches the commented-out examples in the comments of values.yaml.
+var commentedKey = regexp.MustCompile(`^\s*(-\s|-$|[\w./"'-]+:(\s|$)|\.\.\.)`)
+
+// chartTable generates the values table of a chart directory.
+func chartTable(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "values.yaml"))
+	if err != nil {
+		return "", err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return "", err
+	}
+	var values *yaml.Node
+	if len(doc.Content) > 0 {
+		values = doc.Content[0]
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "values.schema.json"))
+	if err != nil {
+		return "", err
+	}
+	var s schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+
+	var rows []row
+	collect("", values, &s, &rows)
+	return formatTable(rows), nil
+}
+
+func formatTable(rows []row) string {
+	var b strings.Builder
+	b.WriteString("\nParameter | Type | Default | Description\n")
+	b.WriteString("--------- | ---- | ------- | -----------\n")
+	for _, r := range rows {
+		fmt.Fprintf(&b, "`%s` | %s | %s | %s\n", r.Name, cell(r.Type), cell(r.Default), cell(r.Description))
+	}
+	return b.String()
+}
+
+func cell(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return strings.ReplaceAll(text, "|", `\|`)
+}
+
+// collect adds the parameters of a mapping of values.yaml and its schema to the rows, in the
+// order of values.yaml and then the keys only the schema has, by name.
+func collect(prefix string, values *yaml.Node, s *schema, rows *[]row) {
+	var keys []string
+	nodes := make(map[string][2]*yaml.Node)
+	if values != nil && values.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(values.Content); i += 2 {
+			key := values.Content[i].Value
+			keys = append(keys, key)
+			nodes[key] = [2]*yaml.Node{values.Content[i], values.Content[i+1]}
+		}
+	}
+	var schemaOnly []string
+	if s != nil {
+		for key := range s.Properties {
+			if _, ok := nodes[key]; !ok {
+				schemaOnly = append(schemaOnly, key)
+			}
+		}
+	}
+	sort.Strings(schemaOnly)
+
+	for _, key := range append(keys, schemaOnly...) {
+		name := prefix + key
+		keyNode, value := nodes[key][0], nodes[key][1]
+		var child *schema
+		if s != nil {
+			child = s.Properties[key]
+		}
+		if !isDocument(name) && isGroup(value, child) {
+			collect(name+".", value, child, rows)
+			continue
+		}
+
+		r := row{Name: name, Type: typeOf(value, child), Default: defaultOf(value)}
+		if child != nil {
+			r.Description = child.Description
+		}
+		if r.Description == "" {
+			r.Description = commentOf(keyNode, value)
+		}
+		*rows = append(*rows, r)
+	}
+}
+
+func isDocument(name string) bool {
+	for _, pattern := range documents {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isGroup returns true if the keys of a value are parameters of their own: the value is a mapping
+// or null, with keys in values.yaml or the schema.
+func isGroup(value *yaml.Node, s *schema) bool {
+	var keys []string
+	if value != nil && value.Kind == yaml.MappingNode {
+		if s != nil && len(s.Properties) == 0 {
+			return false
+		}
+		for i := 0; i < len(value.Content); i += 2 {
+			keys = append(keys, value.Content[i].Value)
+		}
+	} else if value != nil && value.Tag != "!!null" {
+		return false
+	}
+	if s != nil {
+		for key := range s.Properties {
+			keys = append(keys, key)
+		}
+	}
+	return len(keys) > 0
+}
+
+func typeOf(value *yaml.Node, s *schema) string {
+	var types []string
+	if s != nil {
+		for _, t := range s.Type {
+			if t != "null" {
+				types = append(types, t)
+			}
+		}
+		if len(s.Type) == 0 {
+			seen := make(map[string]bool)
+			for _, v := range s.Enum {
+				var t string
+				switch v.(type) {
+				case string:
+					t = "string"
+				case bool:
+					t = "boolean"
+				case float64:
+					t = "integer"
+				}
+				if t != "" && !seen[t] {
+					seen[t] = true
+					types = append(types, t)
+				}
+			}
+		}
+	}
+	if len(types) > 0 {
+		return strings.Join(types, ", ")
+	}
+
+	if value == nil {
+		return ""
+	}
+	switch value.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "array"
+	}
+	switch value.Tag {
+	case "!!str":
+		return "string"
+	case "!!bool":
+		return "boolean"
+	case "!!int":
+		return "integer"
+	case "!!float":
+		return "number"
+	}
+	return ""
+}
+
+// defaultOf formats the default of a parameter, in YAML flow style.
+func defaultOf(value *yaml.Node) string {
+	if value == nil {
+		return ""
+	}
+	switch {
+	case value.Kind == yaml.ScalarNode && value.Tag == "!!null":
+		return "`nil`"
+	case value.Kind == yaml.ScalarNode && value.Value == "":
+		return "`\"\"`"
+	case value.Kind == yaml.ScalarNode:
+		if strings.Contains(value.Value, "\n") || len(value.Value) > maxDefault {
+			return longDefault
+		}
+		return "`" + value.Value + "`"
+	}
+
+	flow := flowCopy(value)
+	out, err := yaml.Marshal(flow)
+	if err != nil {
+		return longDefault
+	}
+	text := strings.TrimSpace(string(out))
+	if strings.Contains(text, "\n") || len(text) > maxDefault {
+		return longDefault
+	}
+	return "`" + text + "`"
+}
+
+// flowCopy copies a node in flow style without its comments.
+func flowCopy(node *yaml.Node) *yaml.Node {
+	c := *node
+	c.HeadComment, c.LineComment, c.FootComment = "", "", ""
+	if c.Kind == yaml.MappingNode || c.Kind == yaml.SequenceNode {
+		c.Style = yaml.FlowStyle
+	}
+	c.Content = nil
+	for _, child := range node.Content {
+		c.Content = append(c.Content, flowCopy(child))
+	}
+	return &c
+}
+
+// commentOf returns the comment of a key in values.yaml: the last paragraph of the comment
+// above it without the commented-out examples, and the comment after it.
+func commentOf(key *yaml.Node, value *yaml.Node) string {
+	if key == nil {
+		return ""
+	}
+	var lines []string
+	head := strings.Split(key.HeadComment, "\n\n")
+	for _, line := range strings.Split(head[len(head)-1], "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "#"))
+		if line == "" || commentedKey.MatchString(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	for _, comment := range []string{key.LineComment, value.LineComment} {
+		if line := strings.TrimSpace(strings.TrimPrefix(comment, "#")); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, " ")
+}
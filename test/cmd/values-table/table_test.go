@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadmeTables(t *testing.T) {
+	for _, chart := range tableCharts {
+		dir := filepath.Join("..", "..", "..", "charts", chart)
+		text, begin, end, err := readme(dir)
+		if err != nil {
+			t.Fatalf("Failed to read the README. chart=%v error=%v\n", chart, err)
+		}
+		table, err := chartTable(dir)
+		if err != nil {
+			t.Fatalf("Failed to generate the values table. chart=%v error=%v\n", chart, err)
+		}
+
+		current := strings.Split(text[begin:end], "\n")
+		expected := strings.Split(table, "\n")
+		for i := 0; i < len(current) || i < len(expected); i++ {
+			var got, want string
+			if i < len(current) {
+				got = current[i]
+			}
+			if i < len(expected) {
+				want = expected[i]
+			}
+			if got != want {
+				t.Errorf("Values table of the %s chart is out of date, run go run ./cmd/values-table to regenerate it.\nREADME:    %s\ngenerated: %s\n", chart, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestChartTable(t *testing.T) {
+	values := `# Default values.
+
+# Image registry
+registry: docker.io
+replicas: 3 # number of replicas
+# Pull secrets, e.g.
+# imagePullSecrets:
+#   - name: my-secret
+imagePullSecrets: []
+tolerations:
+  - effect: NoSchedule
+    key: node-role.kubernetes.io/control-plane
+  - effect: NoSchedule
+    key: node-role.kubernetes.io/etcd
+svc:
+  type: ClusterIP
+  annotations:
+    a: b
+route:
+  enabled: false
+  tls:
+controller:
+  initcfg:
+    ldap:
+      Hostname: ldap.example.com
+`
+	schema := `{
+  "properties": {
+    "registry": {"type": "string"},
+    "replicas": {"type": ["integer", "null"], "description": "Replicas of the deployment"},
+    "svc": {
+      "type": "object",
+      "properties": {
+        "type": {"enum": ["ClusterIP", "NodePort"], "description": "Service type"},
+        "annotations": {"type": "object", "description": "Service annotations"}
+      }
+    },
+    "route": {
+      "type": "object",
+      "properties": {
+        "enabled": {"type": "boolean"},
+        "tls": {
+          "type": ["object", "null"],
+          "properties": {"key": {"type": "string", "description": "TLS key"}}
+        },
+        "host": {"type": "string", "description": "Route host"}
+      }
+    },
+    "controller": {
+      "type": "object",
+      "properties": {
+        "initcfg": {
+          "type": "object",
+          "properties": {
+            "ldap": {"type": "object", "description": "ldapinitcfg.yaml", "properties": {"Hostname": {"type": "string"}}}
+          }
+        }
+      }
+    }
+  }
+}`
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "values.yaml"), []byte(values), 0644); err != nil {
+		t.Fatalf("Failed to write values. error=%v\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "values.schema.json"), []byte(schema), 0644); err != nil {
+		t.Fatalf("Failed to write schema. error=%v\n", err)
+	}
+
+	table, err := chartTable(dir)
+	if err != nil {
+		t.Fatalf("Failed to generate the values table. error=%v\n", err)
+	}
+	expected := "\nParameter | Type | Default | Description\n" +
+		"--------- | ---- | ------- | -----------\n" +
+		"`registry` | string | `docker.io` | Image registry\n" +
+		"`replicas` | integer | `3` | Replicas of the deployment\n" +
+		"`imagePullSecrets` | array | `[]` | Pull secrets, e.g.\n" +
+		"`tolerations` | array | see [values.yaml](values.yaml) | \n" +
+		"`svc.type` | string | `ClusterIP` | Service type\n" +
+		"`svc.annotations` | object | `{a: b}` | Service annotations\n" +
+		"`route.enabled` | boolean | `false` | \n" +
+		"`route.tls.key` | string |  | TLS key\n" +
+		"`route.host` | string |  | Route host\n" +
+		"`controller.initcfg.ldap` | object | `{Hostname: ldap.example.com}` | ldapinitcfg.yaml\n"
+	if table != expected {
+		t.Errorf("Unexpected values table.\n%s\nexpected:\n%s", table, expected)
+	}
+}
@@ -0,0 +1,299 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func containerEnv(c corev1.Container) map[string]corev1.EnvVar {
+	env := make(map[string]corev1.EnvVar)
+	for _, e := range c.Env {
+		env[e.Name] = e
+	}
+	return env
+}
+
+func TestCSPAdapter(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	cases := []struct {
+		name           string
+		values         map[string]string
+		image          string
+		env            []string
+		serviceAccount string
+		annotations    map[string]string
+		noDefaultAdmin bool
+	}{
+		{
+			name: "aws",
+			values: map[string]string{
+				"global.aws.enabled":       "true",
+				"global.aws.accountNumber": "123456789012",
+				"global.aws.roleName":      "csp-billing",
+			},
+			image:          "docker.io/neuvector/neuvector-csp-adapter:latest",
+			serviceAccount: "csp",
+			annotations:    map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::123456789012:role/csp-billing"},
+		},
+		{
+			name: "aws digest",
+			values: map[string]string{
+				"global.aws.enabled":      "true",
+				"global.aws.image.digest": "sha256:0123",
+				"registry":                "registry.example.com",
+			},
+			image:          "registry.example.com/neuvector/neuvector-csp-adapter@sha256:0123",
+			serviceAccount: "csp",
+		},
+		{
+			name: "azure",
+			values: map[string]string{
+				"global.azure.enabled":        "true",
+				"global.azure.serviceAccount": "csp-azure",
+			},
+			image:          "registry.suse.de/suse/sle-15-sp5/update/pubclouds/images/neuvector-billing-azure-by-suse-llc:latest",
+			env:            []string{"CLIENT_ID", "EXTENSION_RESOURCE_ID", "PLAN_ID"},
+			serviceAccount: "csp-azure",
+			noDefaultAdmin: true,
+		},
+		{
+			name: "gcp",
+			values: map[string]string{
+				"global.gcp.enabled":             "true",
+				"global.gcp.serviceAccountEmail": "csp-adapter@my-project.iam.gserviceaccount.com",
+				"global.gcp.reportingSecret":     "neuvector-reporting",
+				"global.gcp.image.tag":           "1.0.0",
+			},
+			image:          "docker.io/neuvector/neuvector-csp-adapter:1.0.0",
+			env:            []string{"CONSUMER_ID", "ENTITLEMENT_ID", "REPORTING_KEY"},
+			serviceAccount: "csp",
+			annotations:    map[string]string{"iam.gke.io/gcp-service-account": "csp-adapter@my-project.iam.gserviceaccount.com"},
+			noDefaultAdmin: true,
+		},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: c.values,
+			Logger:    logger.Discard,
+		}
+		objs, _ := renderObjects(t, helmChartPath, options)
+
+		for _, name := range []string{
+			"CustomResourceDefinition/cspadapterusagerecords.susecloud.net",
+			"ClusterRole/neuvector-csp-adapter-cluster-role",
+			"ClusterRole/neuvector-binding-csp-usages",
+			"Role/neuvector-csp-adapter-role",
+		} {
+			if _, ok := objs[name]; !ok {
+				t.Errorf("%s: %s is not rendered\n", c.name, name)
+			}
+		}
+
+		var dep appsv1.Deployment
+		helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-csp-pod"], &dep)
+		spec := dep.Spec.Template.Spec
+		if len(spec.Containers) != 1 {
+			t.Fatalf("%s: csp adapter containers are wrong. containers=%+v\n", c.name, spec.Containers)
+		}
+		if spec.Containers[0].Image != c.image {
+			t.Errorf("%s: csp adapter image is wrong. image=%v\n", c.name, spec.Containers[0].Image)
+		}
+		env := containerEnv(spec.Containers[0])
+		for _, name := range append([]string{"ADAPTER_NAMESPACE", "USAGE_RESOURCE"}, c.env...) {
+			if _, ok := env[name]; !ok {
+				t.Errorf("%s: csp adapter env %s is missing. env=%+v\n", c.name, name, env)
+			}
+		}
+		if spec.ServiceAccountName != c.serviceAccount {
+			t.Errorf("%s: csp adapter service account is wrong. serviceAccount=%v\n", c.name, spec.ServiceAccountName)
+		}
+
+		var sa corev1.ServiceAccount
+		helm.UnmarshalK8SYaml(t, objs["ServiceAccount/"+c.serviceAccount], &sa)
+		if sa.Name != c.serviceAccount {
+			t.Errorf("%s: csp adapter service account is not rendered\n", c.name)
+		}
+		for k, v := range c.annotations {
+			if sa.Annotations[k] != v {
+				t.Errorf("%s: service account annotation %s is wrong. annotations=%v\n", c.name, k, sa.Annotations)
+			}
+		}
+
+		for _, name := range []string{"ClusterRoleBinding/neuvector-csp-adapter-crb", "RoleBinding/neuvector-csp-adapter-binding"} {
+			var binding rbacv1.RoleBinding
+			helm.UnmarshalK8SYaml(t, objs[name], &binding)
+			if len(binding.Subjects) != 1 || binding.Subjects[0].Name != c.serviceAccount {
+				t.Errorf("%s: %s subjects are wrong. subjects=%+v\n", c.name, name, binding.Subjects)
+			}
+		}
+
+		var ctrl appsv1.Deployment
+		helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-controller-pod"], &ctrl)
+		ctrlEnv := containerEnv(ctrl.Spec.Template.Spec.Containers[0])
+		if csp := ctrlEnv["CSP_ENV"].Value; csp != strings.Fields(c.name)[0] {
+			t.Errorf("%s: controller CSP_ENV is wrong. value=%v\n", c.name, csp)
+		}
+		if _, ok := ctrlEnv["NO_DEFAULT_ADMIN"]; ok != c.noDefaultAdmin {
+			t.Errorf("%s: controller NO_DEFAULT_ADMIN is wrong. env=%+v\n", c.name, ctrlEnv)
+		}
+	}
+}
+
+func TestCSPAdapterGCPReportingSecret(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"global.gcp.enabled":             "true",
+			"global.gcp.serviceAccountEmail": "csp-adapter@my-project.iam.gserviceaccount.com",
+			"global.gcp.reportingSecret":     "neuvector-reporting",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+
+	var dep appsv1.Deployment
+	helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-csp-pod"], &dep)
+	env := containerEnv(dep.Spec.Template.Spec.Containers[0])
+	for name, key := range map[string]string{"CONSUMER_ID": "consumer-id", "ENTITLEMENT_ID": "entitlement-id", "REPORTING_KEY": "reporting-key"} {
+		ref := env[name].ValueFrom
+		if ref == nil || ref.SecretKeyRef == nil || ref.SecretKeyRef.Name != "neuvector-reporting" || ref.SecretKeyRef.Key != key {
+			t.Errorf("%s is not read from the reporting secret. env=%+v\n", name, env[name])
+		}
+	}
+}
+
+func TestCSPAdapterImagePullSecrets(t *testing.T) {
+	cases := []struct {
+		values   map[string]string
+		expected []string
+	}{
+		{map[string]string{"global.aws.imagePullSecrets": "regcred"}, []string{"regcred"}},
+		{map[string]string{"global.aws.imagePullSecrets[0]": "regcred", "global.aws.imagePullSecrets[1].name": "mirror"}, []string{"regcred", "mirror"}},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: mergeValues(map[string]string{"global.aws.enabled": "true"}, c.values),
+			Logger:    logger.Discard,
+		}
+		objs, _ := renderObjects(t, "../charts/core", options)
+
+		var dep appsv1.Deployment
+		helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-csp-pod"], &dep)
+		var names []string
+		for _, s := range dep.Spec.Template.Spec.ImagePullSecrets {
+			names = append(names, s.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("Incorrect image pull secrets. values=%v secrets=%v\n", c.values, names)
+		}
+	}
+}
+
+func TestCSPAdapterAnnotations(t *testing.T) {
+	cases := []struct {
+		values   map[string]string
+		expected string
+	}{
+		{map[string]string{"global.aws.enabled": "true", "global.aws.annotations.team": "billing"}, "billing"},
+		// Azure installs set the annotations of the deployment in global.aws.annotations
+		{map[string]string{"global.azure.enabled": "true", "global.aws.annotations.team": "billing"}, "billing"},
+		{map[string]string{"global.gcp.enabled": "true", "global.gcp.reportingSecret": "reporting", "global.gcp.serviceAccountEmail": "csp-adapter@my-project.iam.gserviceaccount.com", "global.gcp.annotations.team": "billing", "global.aws.annotations.team": "aws"}, "billing"},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: c.values,
+			Logger:    logger.Discard,
+		}
+		objs, _ := renderObjects(t, "../charts/core", options)
+
+		var dep appsv1.Deployment
+		helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-csp-pod"], &dep)
+		if team := dep.Annotations["team"]; team != c.expected {
+			t.Errorf("Incorrect csp adapter annotations. values=%v annotations=%v\n", c.values, dep.Annotations)
+		}
+	}
+}
+
+func TestCSPAdapterDisabled(t *testing.T) {
+	options := &helm.Options{
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+	for name := range objs {
+		if strings.Contains(name, "csp") {
+			t.Errorf("%s should not be rendered\n", name)
+		}
+	}
+
+	var ctrl appsv1.Deployment
+	helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-controller-pod"], &ctrl)
+	env := containerEnv(ctrl.Spec.Template.Spec.Containers[0])
+	for _, name := range []string{"CSP_ENV", "NO_DEFAULT_ADMIN"} {
+		if _, ok := env[name]; ok {
+			t.Errorf("Controller env %s should not be set\n", name)
+		}
+	}
+}
+
+func TestCSPAdapterOpenShift(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"openshift":                      "true",
+			"global.gcp.enabled":             "true",
+			"global.gcp.serviceAccountEmail": "csp-adapter@my-project.iam.gserviceaccount.com",
+			"global.gcp.reportingSecret":     "neuvector-reporting",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+	if _, ok := objs["ServiceAccount/csp"]; ok {
+		t.Errorf("The csp adapter service account should not be rendered on OpenShift\n")
+	}
+	if _, ok := objs["Deployment/neuvector-csp-pod"]; !ok {
+		t.Errorf("The csp adapter is not rendered\n")
+	}
+}
+
+func TestCSPAdapterErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		values map[string]string
+		err    string
+	}{
+		{
+			name:   "two clouds",
+			values: map[string]string{"global.aws.enabled": "true", "global.gcp.enabled": "true", "global.gcp.reportingSecret": "neuvector-reporting"},
+			err:    "only one of global.aws, global.azure and global.gcp can be enabled, got aws, gcp",
+		},
+		{
+			name:   "gcp reporting secret",
+			values: map[string]string{"global.gcp.enabled": "true", "global.gcp.serviceAccountEmail": "csp-adapter@my-project.iam.gserviceaccount.com"},
+			err:    "global.gcp.reportingSecret is required",
+		},
+		{
+			name:   "gcp workload identity",
+			values: map[string]string{"global.gcp.enabled": "true", "global.gcp.reportingSecret": "neuvector-reporting"},
+			err:    "global.gcp.serviceAccountEmail is required for Workload Identity",
+		},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: c.values,
+			Logger:    logger.Discard,
+		}
+		_, err := helm.RenderTemplateE(t, options, "../charts/core", nvRel, []string{})
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: unexpected error. expected=%v actual=%v\n", c.name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Package envtest applies the rendered charts to a local kube-apiserver and etcd started by
+// controller-runtime envtest. The API server validates what rendering cannot: the CRD schemas,
+// defaulting, and the fields an upgrade cannot change. There are no controllers and no nodes, so
+// workloads are never scheduled. Install the binaries once, they are not downloaded by the test:
+//
+//	go install sigs.k8s.io/controller-runtime/tools/setup-envtest@release-0.22
+//	export KUBEBUILDER_ASSETS=$(setup-envtest use -p path 1.33.x)
+//	cd test && go test ./envtest
+package envtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	releaseName      = "neuvector"
+	releaseNamespace = "neuvector"
+	fieldManager     = "helm"
+)
+
+var charts = []string{"crd", "core", "monitor"}
+
+// applyScenarios are the fixtures in ../fixtures applied in turn: the first one is installed and
+// each of the others upgrades the release.
+var applyScenarios = []string{"default", "leastPrivilege", "certmanager", "resources", "federation", "gitops"}
+
+// installOrder is the order helm applies the kinds in, kinds not listed are applied last.
+var installOrder = []string{
+	"PriorityClass", "Namespace", "NetworkPolicy", "ResourceQuota", "LimitRange", "PodSecurityPolicy",
+	"PodDisruptionBudget", "ServiceAccount", "Secret", "ConfigMap", "StorageClass", "PersistentVolume",
+	"PersistentVolumeClaim", "CustomResourceDefinition", "ClusterRole", "ClusterRoleBinding", "Role",
+	"RoleBinding", "Service", "DaemonSet", "Pod", "ReplicationController", "ReplicaSet", "Deployment",
+	"HorizontalPodAutoscaler", "StatefulSet", "Job", "CronJob", "IngressClass", "Ingress", "APIService",
+	"MutatingWebhookConfiguration", "ValidatingWebhookConfiguration",
+}
+
+// fixture is the part of a scenario in ../fixtures/*.yaml the apply test uses.
+type fixture struct {
+	APIVersions []string               `json:"apiVersions"`
+	Core        map[string]interface{} `json:"core"`
+	CRD         map[string]interface{} `json:"crd"`
+	Monitor     map[string]interface{} `json:"monitor"`
+}
+
+func (f *fixture) values(chart string) map[string]interface{} {
+	switch chart {
+	case "core":
+		return f.Core
+	case "crd":
+		return f.CRD
+	default:
+		return f.Monitor
+	}
+}
+
+// binariesInstalled reports if envtest can find kube-apiserver and etcd.
+func binariesInstalled() bool {
+	if os.Getenv("KUBEBUILDER_ASSETS") != "" {
+		return true
+	}
+	_, err := os.Stat("/usr/local/kubebuilder/bin/kube-apiserver")
+	return err == nil
+}
+
+// thirdPartyCRDs returns the definitions of the custom resources the charts create for other
+// operators, such as ServiceMonitor and Certificate, with the schemas in ../schemas/crds. Routes
+// are left out, the charts detect OpenShift from them.
+func thirdPartyCRDs(t *testing.T) []*apiextensionsv1.CustomResourceDefinition {
+	paths, err := filepath.Glob(filepath.Join("..", "schemas", "crds", "*.json"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No CRD schemas found. error=%v\n", err)
+	}
+
+	crds := make(map[string]*apiextensionsv1.CustomResourceDefinition)
+	var names []string
+	for _, path := range paths {
+		// <group>_<version>_<kind>.json
+		parts := strings.Split(strings.TrimSuffix(filepath.Base(path), ".json"), "_")
+		if len(parts) != 3 {
+			t.Fatalf("Unexpected CRD schema file name. file=%v\n", path)
+		}
+		group, version, kind := parts[0], parts[1], parts[2]
+		if group == "route.openshift.io" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read the CRD schema. file=%v error=%v\n", path, err)
+		}
+		var schema apiextensionsv1.JSONSchemaProps
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatalf("Failed to parse the CRD schema. file=%v error=%v\n", path, err)
+		}
+
+		plural := strings.ToLower(kind) + "s"
+		name := plural + "." + group
+		crd, ok := crds[name]
+		if !ok {
+			crd = &apiextensionsv1.CustomResourceDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+					Group: group,
+					Names: apiextensionsv1.CustomResourceDefinitionNames{
+						Kind:     kind,
+						ListKind: kind + "List",
+						Plural:   plural,
+						Singular: strings.ToLower(kind),
+					},
+					Scope: apiextensionsv1.NamespaceScoped,
+				},
+			}
+			crds[name] = crd
+			names = append(names, name)
+		}
+		crd.Spec.Versions = append(crd.Spec.Versions, apiextensionsv1.CustomResourceDefinitionVersion{
+			Name:    version,
+			Served:  true,
+			Storage: version == "v1",
+			Schema:  &apiextensionsv1.CustomResourceValidation{OpenAPIV3Schema: &schema},
+		})
+	}
+
+	sort.Strings(names)
+	result := make([]*apiextensionsv1.CustomResourceDefinition, 0, len(names))
+	for _, name := range names {
+		result = append(result, crds[name])
+	}
+	return result
+}
+
+// startAPIServer starts kube-apiserver and etcd with the third-party CRDs registered.
+func startAPIServer(t *testing.T) *rest.Config {
+	if !binariesInstalled() {
+		t.Skip("kube-apiserver and etcd are not installed, set KUBEBUILDER_ASSETS to the directory setup-envtest installs them to")
+	}
+
+	env := &envtest.Environment{
+		CRDs:                  thirdPartyCRDs(t),
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatalf("Failed to start the API server. error=%v\n", err)
+	}
+	t.Cleanup(func() {
+		if err := env.Stop(); err != nil {
+			t.Errorf("Failed to stop the API server. error=%v\n", err)
+		}
+	})
+	return cfg
+}
+
+// capabilities returns the Kubernetes version and the API versions served by the API server, the
+// same helm install reads from the cluster.
+func capabilities(t *testing.T, cfg *rest.Config) (string, []string) {
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create the discovery client. error=%v\n", err)
+	}
+	version, err := dc.ServerVersion()
+	if err != nil {
+		t.Fatalf("Failed to get the server version. error=%v\n", err)
+	}
+	groups, err := dc.ServerGroups()
+	if err != nil {
+		t.Fatalf("Failed to get the server groups. error=%v\n", err)
+	}
+
+	var apiVersions []string
+	for _, group := range groups.Groups {
+		for _, v := range group.Versions {
+			apiVersions = append(apiVersions, v.GroupVersion)
+		}
+	}
+	return strings.TrimPrefix(version.GitVersion, "v"), apiVersions
+}
+
+func readFixture(t *testing.T, name string) *fixture {
+	path := filepath.Join("..", "fixtures", name+".yaml")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read fixture. file=%v error=%v\n", path, err)
+	}
+	var f fixture
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		t.Fatalf("Failed to parse fixture. file=%v error=%v\n", path, err)
+	}
+	return &f
+}
+
+// render renders a chart with the values of a fixture and the capabilities of the API server.
+func render(t *testing.T, f *fixture, chart string, kubeVersion string, apiVersions []string) []*unstructured.Unstructured {
+	values, err := yaml.Marshal(f.values(chart))
+	if err != nil {
+		t.Fatalf("Failed to marshal values. chart=%v error=%v\n", chart, err)
+	}
+	valuesFile := filepath.Join(t.TempDir(), chart+".yaml")
+	if err := os.WriteFile(valuesFile, values, 0644); err != nil {
+		t.Fatalf("Failed to write values. chart=%v error=%v\n", chart, err)
+	}
+
+	options := &helm.Options{
+		KubectlOptions: k8s.NewKubectlOptions("", "", releaseNamespace),
+		ValuesFiles:    []string{valuesFile},
+		Logger:         logger.Discard,
+	}
+	args := []string{"--kube-version", kubeVersion}
+	for _, api := range append(apiVersions, f.APIVersions...) {
+		args = append(args, "--api-versions", api)
+	}
+	out, err := helm.RenderTemplateE(t, options, filepath.Join("..", "..", "charts", chart), releaseName, []string{}, args...)
+	if err != nil {
+		t.Fatalf("%s chart does not render the values. error=%v\n", chart, err)
+	}
+
+	var objs []*unstructured.Unstructured
+	for _, doc := range strings.Split(out, "\n---") {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			t.Fatalf("Failed to parse manifest. chart=%v error=%v\n%s", chart, err, doc)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		objs = append(objs, &unstructured.Unstructured{Object: obj})
+	}
+	return objs
+}
+
+func installRank(kind string) int {
+	for i, k := range installOrder {
+		if k == kind {
+			return i
+		}
+	}
+	return len(installOrder)
+}
+
+func objectKey(obj *unstructured.Unstructured) string {
+	return fmt.Sprintf("%s/%s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
+
+func isHook(obj *unstructured.Unstructured) bool {
+	_, ok := obj.GetAnnotations()["helm.sh/hook"]
+	return ok
+}
+
+// releaseApplier applies the renderings of a release like helm install and upgrade.
+type releaseApplier struct {
+	t       *testing.T
+	ctx     context.Context
+	client  client.Client
+	applied map[string]*unstructured.Unstructured
+}
+
+// apply applies the objects in the install order of helm, with the custom resource definitions
+// established before the rest, and deletes the objects of the previous rendering that are gone.
+func (a *releaseApplier) apply(objs []*unstructured.Unstructured) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		return installRank(objs[i].GetKind()) < installRank(objs[j].GetKind())
+	})
+
+	var crds, others []*unstructured.Unstructured
+	for _, obj := range objs {
+		if obj.GetKind() == "CustomResourceDefinition" {
+			crds = append(crds, obj)
+		} else {
+			others = append(others, obj)
+		}
+	}
+
+	current := make(map[string]*unstructured.Unstructured)
+	for _, obj := range crds {
+		a.applyObject(obj)
+		current[objectKey(obj)] = obj
+	}
+	for _, obj := range crds {
+		a.waitEstablished(obj.GetName())
+	}
+	for _, obj := range others {
+		a.applyObject(obj)
+		current[objectKey(obj)] = obj
+	}
+
+	for key, obj := range a.applied {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		if err := a.client.Delete(a.ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			a.t.Errorf("%s is not rendered anymore and cannot be deleted. error=%v\n", key, err)
+		}
+	}
+	a.applied = current
+}
+
+// applyObject creates or updates an object with server-side apply. Hooks are deleted and created
+// again, like the default before-hook-creation delete policy of helm.
+func (a *releaseApplier) applyObject(obj *unstructured.Unstructured) {
+	mapping, err := a.client.RESTMapper().RESTMapping(obj.GroupVersionKind().GroupKind(), obj.GroupVersionKind().Version)
+	if err != nil {
+		a.t.Errorf("%s/%s %s is not served. error=%v\n", obj.GetKind(), obj.GetName(), obj.GetAPIVersion(), err)
+		return
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace && obj.GetNamespace() == "" {
+		obj.SetNamespace(releaseNamespace)
+	}
+
+	if isHook(obj) {
+		err := a.client.Delete(a.ctx, obj.DeepCopy(), client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			a.t.Errorf("Failed to delete hook %s. error=%v\n", objectKey(obj), err)
+		}
+	}
+
+	if err := a.client.Patch(a.ctx, obj.DeepCopy(), client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		a.t.Errorf("%s is rejected. error=%v\n", objectKey(obj), err)
+	}
+}
+
+// waitEstablished waits until the API server serves the resources of a custom resource definition.
+func (a *releaseApplier) waitEstablished(name string) {
+	err := wait.PollUntilContextTimeout(a.ctx, 100*time.Millisecond, 30*time.Second, true, func(ctx context.Context) (bool, error) {
+		var crd apiextensionsv1.CustomResourceDefinition
+		if err := a.client.Get(ctx, client.ObjectKey{Name: name}, &crd); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		for _, cond := range crd.Status.Conditions {
+			if cond.Type == apiextensionsv1.NonStructuralSchema && cond.Status == apiextensionsv1.ConditionTrue {
+				return false, fmt.Errorf("schema is not structural: %s", cond.Message)
+			}
+		}
+		for _, cond := range crd.Status.Conditions {
+			if cond.Type == apiextensionsv1.Established && cond.Status == apiextensionsv1.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		a.t.Errorf("CustomResourceDefinition/%s is not established. error=%v\n", name, err)
+	}
+}
+
+// TestApply installs the charts with the first scenario of applyScenarios and upgrades them with
+// each of the others, and checks that the API server accepts every object.
+func TestApply(t *testing.T) {
+	cfg := startAPIServer(t)
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Failed to register the Kubernetes types. error=%v\n", err)
+	}
+	if err := apiextensionsv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("Failed to register the CRD types. error=%v\n", err)
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatalf("Failed to create the client. error=%v\n", err)
+	}
+
+	ctx := context.Background()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: releaseNamespace}}
+	if err := c.Create(ctx, ns); err != nil {
+		t.Fatalf("Failed to create the release namespace. error=%v\n", err)
+	}
+
+	kubeVersion, apiVersions := capabilities(t, cfg)
+	applier := &releaseApplier{t: t, ctx: ctx, client: c}
+	for i, name := range applyScenarios {
+		step := "install"
+		if i > 0 {
+			step = "upgrade"
+		}
+		f := readFixture(t, name)
+		t.Run(fmt.Sprintf("%s %s", step, name), func(t *testing.T) {
+			applier.t = t
+			var objs []*unstructured.Unstructured
+			for _, chart := range charts {
+				objs = append(objs, render(t, f, chart, kubeVersion, apiVersions)...)
+			}
+			applier.apply(objs)
+		})
+	}
+}
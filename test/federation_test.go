@@ -0,0 +1,422 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/strvals"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+)
+
+// renderWithSecrets renders the chart templates with the lookup function served by a fake API
+// server that holds the given secrets, the way an install on a cluster does.
+func renderWithSecrets(t *testing.T, chart string, setValues map[string]string, secrets ...corev1.Secret) (map[string]string, error) {
+	values := make(map[string]interface{})
+	for k, v := range setValues {
+		if err := strvals.ParseInto(k+"="+v, values); err != nil {
+			t.Fatalf("Failed to parse value. key=%v error=%v\n", k, err)
+		}
+	}
+	return renderValuesWithSecrets(t, chart, values, secrets...)
+}
+
+func renderValuesWithSecrets(t *testing.T, chart string, values map[string]interface{}, secrets ...corev1.Secret) (map[string]string, error) {
+	objects := make([]runtime.Object, len(secrets))
+	for i := range secrets {
+		secrets[i].TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+		objects[i] = &secrets[i]
+	}
+	return renderValuesWithCluster(t, chart, values, nil, objects...)
+}
+
+// clusterResources are the resources the fake API server of renderValuesWithCluster serves, by
+// group version.
+var clusterResources = map[string][]metav1.APIResource{
+	"v1":             {{Name: "secrets", Namespaced: true, Kind: "Secret", Verbs: metav1.Verbs{"get", "list"}}},
+	"autoscaling/v2": {{Name: "horizontalpodautoscalers", Namespaced: true, Kind: "HorizontalPodAutoscaler", Verbs: metav1.Verbs{"get", "list"}}},
+}
+
+// renderValuesWithCluster renders the chart templates with the lookup function served by a fake
+// API server that holds the given objects, and with the API versions added to the capabilities.
+func renderValuesWithCluster(t *testing.T, chart string, values map[string]interface{}, apiVersions []string, objects ...runtime.Object) (map[string]string, error) {
+	// paths of the objects and of the lists of their resource
+	items := make(map[string][]map[string]interface{})
+	for _, obj := range objects {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			t.Fatalf("Failed to convert object. error=%v\n", err)
+		}
+		u := unstructured.Unstructured{Object: content}
+		prefix := "/apis/" + u.GetAPIVersion()
+		if u.GetAPIVersion() == "v1" {
+			prefix = "/api/v1"
+		}
+		for _, res := range clusterResources[u.GetAPIVersion()] {
+			if res.Kind == u.GetKind() {
+				list := prefix + "/namespaces/" + u.GetNamespace() + "/" + res.Name
+				items[list] = append(items[list], content)
+				items[list+"/"+u.GetName()] = []map[string]interface{}{content}
+			}
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for gv, resources := range clusterResources {
+			if r.URL.Path == "/api/"+gv || r.URL.Path == "/apis/"+gv {
+				json.NewEncoder(w).Encode(metav1.APIResourceList{
+					TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList"},
+					GroupVersion: gv,
+					APIResources: resources,
+				})
+				return
+			}
+			for _, res := range resources {
+				if strings.HasSuffix(r.URL.Path, "/"+res.Name) {
+					// an empty list when no object of the resource is in the namespace
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"apiVersion": gv,
+						"kind":       res.Kind + "List",
+						"metadata":   map[string]interface{}{},
+						"items":      items[r.URL.Path],
+					})
+					return
+				}
+			}
+		}
+		if objs, ok := items[r.URL.Path]; ok {
+			json.NewEncoder(w).Encode(objs[0])
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+	}))
+	defer server.Close()
+
+	chrt, err := loader.Load("../charts/" + chart)
+	if err != nil {
+		t.Fatalf("Failed to load chart. chart=%v error=%v\n", chart, err)
+	}
+	caps := *chartutil.DefaultCapabilities
+	caps.APIVersions = append(append(chartutil.VersionSet{}, caps.APIVersions...), apiVersions...)
+	options := chartutil.ReleaseOptions{Name: nvRel, Namespace: "neuvector", IsInstall: true}
+	vals, err := chartutil.ToRenderValues(chrt, values, options, &caps)
+	if err != nil {
+		return nil, err
+	}
+	return engine.New(&rest.Config{Host: server.URL}).Render(chrt, vals)
+}
+
+func joinTokenSecret(name string, key string, token string) corev1.Secret {
+	return corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "neuvector"},
+		Data:       map[string][]byte{key: []byte(token)},
+	}
+}
+
+// fedInitConfig decodes fedinitcfg.yaml of the neuvector-init secret, or returns nil when the
+// secret or the file is not rendered.
+func fedInitConfig(t *testing.T, out string) map[string]interface{} {
+	for _, output := range splitYaml(out) {
+		var obj namedObject
+		helm.UnmarshalK8SYaml(t, output, &obj)
+		if obj.Kind != "Secret" || obj.Name != "neuvector-init" {
+			continue
+		}
+		var secret corev1.Secret
+		helm.UnmarshalK8SYaml(t, output, &secret)
+		data, ok := secret.Data["fedinitcfg.yaml"]
+		if !ok {
+			return nil
+		}
+		var cfg map[string]interface{}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			t.Fatalf("Failed to parse fedinitcfg.yaml. error=%v\n%s", err, data)
+		}
+		return cfg
+	}
+	return nil
+}
+
+func checkFedInitConfig(t *testing.T, name string, cfg map[string]interface{}, expected string) {
+	var exp map[string]interface{}
+	if err := yaml.Unmarshal([]byte(expected), &exp); err != nil {
+		t.Fatalf("Failed to parse expected config. error=%v\n", err)
+	}
+	actual, _ := yaml.Marshal(cfg)
+	want, _ := yaml.Marshal(exp)
+	if string(actual) != string(want) {
+		t.Errorf("%s: fedinitcfg.yaml is wrong.\nexpected:\n%s\nactual:\n%s", name, want, actual)
+	}
+}
+
+func TestFederationNone(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"controller.federation.clusterName":    "cluster1",
+			"controller.federation.master.address": "fed.example.com",
+		},
+		Logger: logger.Discard,
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{})
+	if cfg := fedInitConfig(t, out); cfg != nil {
+		t.Errorf("fedinitcfg.yaml should not be generated. cfg=%v\n", cfg)
+	}
+	if strings.Contains(out, "neuvector-svc-controller-fed-") {
+		t.Errorf("Federation services should not be created without a role\n")
+	}
+}
+
+func TestFederationMaster(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	cases := []struct {
+		name     string
+		values   map[string]string
+		svcType  string
+		expected string
+	}{
+		{
+			name: "address",
+			values: map[string]string{
+				"controller.federation.master.address": "10.1.1.1",
+			},
+			svcType:  "ClusterIP",
+			expected: "fed_role: master\nname: cluster1\nmaster_rest_info:\n  server: 10.1.1.1\n  port: 11443\n",
+		},
+		{
+			name: "ingress host",
+			values: map[string]string{
+				"controller.federation.mastersvc.ingress.enabled": "true",
+				"controller.federation.mastersvc.ingress.host":    "fed.example.com",
+				"controller.federation.useProxy":                  "https",
+			},
+			svcType:  "ClusterIP",
+			expected: "fed_role: master\nname: cluster1\nmaster_rest_info:\n  server: fed.example.com\n  port: 443\nuse_proxy: https\n",
+		},
+		{
+			name: "route host",
+			values: map[string]string{
+				"openshift": "true",
+				"controller.federation.mastersvc.route.enabled": "true",
+				"controller.federation.mastersvc.route.host":    "fed.apps.example.com",
+			},
+			svcType:  "ClusterIP",
+			expected: "fed_role: master\nname: cluster1\nmaster_rest_info:\n  server: fed.apps.example.com\n  port: 443\n",
+		},
+		{
+			name: "load balancer",
+			values: map[string]string{
+				"controller.federation.mastersvc.type":           "LoadBalancer",
+				"controller.federation.mastersvc.loadBalancerIP": "10.2.2.2",
+				"controller.federation.master.port":              "11443",
+			},
+			svcType:  "LoadBalancer",
+			expected: "fed_role: master\nname: cluster1\nmaster_rest_info:\n  server: 10.2.2.2\n  port: 11443\n",
+		},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: map[string]string{
+				"controller.federation.role":        "master",
+				"controller.federation.clusterName": "cluster1",
+			},
+			Logger: logger.Discard,
+		}
+		for k, v := range c.values {
+			options.SetValues[k] = v
+		}
+
+		out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{})
+		checkFedInitConfig(t, c.name, fedInitConfig(t, out), c.expected)
+
+		var master, managed int
+		for _, output := range splitYaml(out) {
+			var obj namedObject
+			helm.UnmarshalK8SYaml(t, output, &obj)
+			if obj.Kind != "Service" {
+				continue
+			}
+			var svc corev1.Service
+			helm.UnmarshalK8SYaml(t, output, &svc)
+			switch svc.Name {
+			case "neuvector-svc-controller-fed-master":
+				master++
+				checkControllerServiceFedMaster(t, svc, c.svcType)
+			case "neuvector-svc-controller-fed-managed":
+				managed++
+			}
+		}
+		if master != 1 || managed != 0 {
+			t.Errorf("%s: federation services are wrong. master=%v managed=%v\n", c.name, master, managed)
+		}
+	}
+}
+
+func TestFederationManaged(t *testing.T) {
+	values := map[string]string{
+		"controller.federation.role":                 "managed",
+		"controller.federation.clusterName":          "cluster2",
+		"controller.federation.master.address":       "fed.example.com",
+		"controller.federation.master.port":          "443",
+		"controller.federation.managed.address":      "10.3.3.3",
+		"controller.federation.joinToken.secretName": "fed-join",
+	}
+	secret := joinTokenSecret("fed-join", "joinToken", "token-from-primary")
+
+	out, err := renderWithSecrets(t, "core", values, secret)
+	if err != nil {
+		t.Fatalf("Failed to render chart. error=%v\n", err)
+	}
+	// the token is read by the controller pod, not copied into the init secret
+	for name, content := range out {
+		if strings.Contains(content, "token-from-primary") {
+			t.Errorf("The join token is rendered in %s\n", name)
+		}
+	}
+	files := resolveInitFiles(t, out, secret)
+	cfg, _ := files["fedinitcfg.yaml"].(map[string]interface{})
+	checkFedInitConfig(t, "managed", cfg,
+		"fed_role: joint\nname: cluster2\nserver: fed.example.com\nport: 443\njoin_token: token-from-primary\njoint_rest_info:\n  server: 10.3.3.3\n  port: 10443\n")
+
+	var dep appsv1.Deployment
+	helm.UnmarshalK8SYaml(t, out["core/templates/controller-deployment.yaml"], &dep)
+	for _, m := range dep.Spec.Template.Spec.Containers[0].VolumeMounts {
+		if m.MountPath == "/etc/config" && m.Name != "config-resolved" {
+			t.Errorf("The controller should read the resolved init config. volume=%v\n", m.Name)
+		}
+	}
+
+	svcs := out["core/templates/controller-service.yaml"]
+	if !strings.Contains(svcs, "name: neuvector-svc-controller-fed-managed") || strings.Contains(svcs, "name: neuvector-svc-controller-fed-master") {
+		t.Errorf("Federation services are wrong.\n%s", svcs)
+	}
+
+	// the managed endpoint defaults to the managed service ingress, with a token key of another name
+	// and a token that has to be quoted in YAML
+	values["controller.federation.managed.address"] = ""
+	values["controller.federation.managedsvc.ingress.enabled"] = "true"
+	values["controller.federation.managedsvc.ingress.host"] = "managed.example.com"
+	values["controller.federation.joinToken.secretKey"] = "token"
+	secret = joinTokenSecret("fed-join", "token", `another: "token" \ #1`)
+	out, err = renderWithSecrets(t, "core", values, secret)
+	if err != nil {
+		t.Fatalf("Failed to render chart. error=%v\n", err)
+	}
+	files = resolveInitFiles(t, out, secret)
+	cfg, _ = files["fedinitcfg.yaml"].(map[string]interface{})
+	checkFedInitConfig(t, "managed ingress", cfg,
+		"fed_role: joint\nname: cluster2\nserver: fed.example.com\nport: 443\njoin_token: 'another: \"token\" \\ #1'\njoint_rest_info:\n  server: managed.example.com\n  port: 443\n")
+}
+
+func TestFederationSecretData(t *testing.T) {
+	values := map[string]string{
+		"controller.federation.role":           "master",
+		"controller.federation.clusterName":    "cluster1",
+		"controller.federation.master.address": "10.1.1.1",
+		"controller.secret.enabled":            "true",
+	}
+
+	out, err := renderWithSecrets(t, "core", values)
+	if err != nil {
+		t.Fatalf("Failed to render chart. error=%v\n", err)
+	}
+	var secret corev1.Secret
+	helm.UnmarshalK8SYaml(t, out["core/templates/init-secret.yaml"], &secret)
+	if _, ok := secret.Data["userinitcfg.yaml"]; !ok {
+		t.Errorf("userinitcfg.yaml is missing. keys=%v\n", secret.Data)
+	}
+	if _, ok := secret.Data["fedinitcfg.yaml"]; !ok {
+		t.Errorf("fedinitcfg.yaml is missing. keys=%v\n", secret.Data)
+	}
+}
+
+func TestFederationErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		values map[string]string
+		err    string
+	}{
+		{
+			name:   "cluster name",
+			values: map[string]string{"controller.federation.role": "master", "controller.federation.master.address": "10.1.1.1"},
+			err:    "controller.federation.clusterName is required for the master role",
+		},
+		{
+			name:   "master address",
+			values: map[string]string{"controller.federation.role": "master", "controller.federation.clusterName": "cluster1"},
+			err:    "controller.federation.master.address is required",
+		},
+		{
+			name:   "primary cluster address",
+			values: map[string]string{"controller.federation.role": "managed", "controller.federation.clusterName": "cluster2"},
+			err:    "controller.federation.master.address of the primary cluster is required for the managed role",
+		},
+		{
+			name: "join token secret",
+			values: map[string]string{
+				"controller.federation.role":            "managed",
+				"controller.federation.clusterName":     "cluster2",
+				"controller.federation.master.address":  "fed.example.com",
+				"controller.federation.managed.address": "10.3.3.3",
+			},
+			err: "controller.federation.joinToken.secretName is required for the managed role",
+		},
+		{
+			name: "managed address",
+			values: map[string]string{
+				"controller.federation.role":                 "managed",
+				"controller.federation.clusterName":          "cluster2",
+				"controller.federation.master.address":       "fed.example.com",
+				"controller.federation.joinToken.secretName": "other",
+			},
+			err: "controller.federation.managed.address is required",
+		},
+		{
+			name: "hand-written fedinitcfg.yaml",
+			values: map[string]string{
+				"controller.federation.role":                  "master",
+				"controller.federation.clusterName":           "cluster1",
+				"controller.federation.master.address":        "10.1.1.1",
+				"controller.configmap.enabled":                "true",
+				"controller.configmap.data.fedinitcfg\\.yaml": "fed_role: master",
+			},
+			err: "controller.configmap.data.fedinitcfg.yaml cannot be set with controller.federation.role",
+		},
+		{
+			name:   "role",
+			values: map[string]string{"controller.federation.role": "primary"},
+			err:    "at '/controller/federation/role': value must be one of 'master', 'managed', 'none'",
+		},
+	}
+
+	for _, c := range cases {
+		_, err := renderWithSecrets(t, "core", c.values, joinTokenSecret("other", "joinToken", "token"))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: unexpected error. expected=%v actual=%v\n", c.name, c.err, err)
+		}
+	}
+}
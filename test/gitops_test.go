@@ -0,0 +1,458 @@
+package test
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"helm.sh/helm/v3/pkg/strvals"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var gitopsCases = []struct {
+	name        string
+	values      map[string]string
+	apiVersions []string
+}{
+	{
+		name: "job",
+		values: map[string]string{
+			"gitops.enabled":                  "true",
+			"bootstrapPassword.generate":      "true",
+			"cve.adapter.enabled":             "true",
+			"controller.apisvc.type":          "ClusterIP",
+			"controller.apisvc.route.enabled": "true",
+			"openshift":                       "true",
+		},
+		apiVersions: []string{"route.openshift.io/v1"},
+	},
+	{
+		name: "certmanager",
+		values: map[string]string{
+			"gitops.enabled":               "true",
+			"gitops.certificates":          "certmanager",
+			"internal.certmanager.enabled": "true",
+			"global.aws.enabled":           "true",
+		},
+		apiVersions: []string{"cert-manager.io/v1"},
+	},
+	{
+		name: "user certificates",
+		values: map[string]string{
+			"gitops.enabled":                     "true",
+			"controller.certificate.key":         "key",
+			"controller.certificate.certificate": "cert",
+			"manager.certificate.secret":         "manager-tls",
+			"bootstrapPassword.value":            "password",
+		},
+	},
+	{
+		name: "federation join token",
+		values: map[string]string{
+			"gitops.enabled":                             "true",
+			"controller.federation.role":                 "managed",
+			"controller.federation.clusterName":          "edge",
+			"controller.federation.master.address":       "primary.example.com",
+			"controller.federation.managed.address":      "edge.example.com",
+			"controller.federation.joinToken.secretName": "join",
+		},
+	},
+	{
+		name: "bootstrap password secret",
+		values: map[string]string{
+			"gitops.enabled":                   "true",
+			"bootstrapPassword.existingSecret": "admin",
+		},
+	},
+	{
+		name: "init config secretKeyRef",
+		values: map[string]string{
+			"gitops.enabled":                                          "true",
+			"controller.initcfg.ldap.directory":                       "OpenLDAP",
+			"controller.initcfg.ldap.Hostname":                        "ldap.example.com",
+			"controller.initcfg.ldap.base_dn":                         "dc=example",
+			"controller.initcfg.ldap.bind_password.secretKeyRef.name": "ldap-bind",
+			"controller.initcfg.ldap.bind_password.secretKeyRef.key":  "password",
+		},
+	},
+	{
+		name: "autoscalers and admission webhook",
+		values: mergeValues(vpaValues, map[string]string{
+			"gitops.enabled":                         "true",
+			"admissionwebhook.configuration.enabled": "true",
+		}),
+		apiVersions: []string{"autoscaling.k8s.io/v1"},
+	},
+}
+
+// gitopsClusterObjects are objects an install leaves in the cluster, which the chart would read
+// with lookup outside of GitOps mode.
+func gitopsClusterObjects() []runtime.Object {
+	secret := func(name string, data map[string][]byte) runtime.Object {
+		return &corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "neuvector"},
+			Data:       data,
+		}
+	}
+	cert := map[string][]byte{"ssl-cert.key": []byte("existing key"), "ssl-cert.pem": []byte("existing cert")}
+	return []runtime.Object{
+		secret("neuvector-controller-secret", cert),
+		secret("neuvector-manager-secret", cert),
+		secret("neuvector-registry-adapter-secret", cert),
+		secret("neuvector-bootstrap-secret", map[string][]byte{"bootstrapPassword": []byte("existing")}),
+		secret("neuvector-internal-certs", map[string][]byte{"ca.crt": []byte("existing ca")}),
+		secret("join", map[string][]byte{"joinToken": []byte("existing token")}),
+		secret("admin", map[string][]byte{"bootstrapPassword": []byte("existing password")}),
+		secret("ldap-bind", map[string][]byte{"password": []byte("existing password")}),
+		&autoscalingv2.HorizontalPodAutoscaler{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "autoscaling/v2", Kind: "HorizontalPodAutoscaler"},
+			ObjectMeta: metav1.ObjectMeta{Name: "neuvector-manager-pod", Namespace: "neuvector"},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "neuvector-manager-pod"},
+				MaxReplicas:    5,
+			},
+		},
+	}
+}
+
+func TestGitOpsRenderIdentical(t *testing.T) {
+	for _, c := range gitopsCases {
+		args := []string{}
+		for _, v := range c.apiVersions {
+			args = append(args, "--api-versions", v)
+		}
+		options := &helm.Options{
+			SetValues: c.values,
+			Logger:    logger.Discard,
+		}
+		first := helm.RenderTemplate(t, options, "../charts/core", nvRel, []string{}, args...)
+		second := helm.RenderTemplate(t, options, "../charts/core", nvRel, []string{}, args...)
+		if first != second {
+			t.Errorf("%s: two renders are different\n", c.name)
+		}
+
+		// the objects in the cluster change nothing, since they are not looked up
+		values := make(map[string]interface{})
+		for k, v := range c.values {
+			if err := strvals.ParseInto(k+"="+v, values); err != nil {
+				t.Fatalf("Failed to parse value. key=%v error=%v\n", k, err)
+			}
+		}
+		empty, err := renderValuesWithCluster(t, "core", values, c.apiVersions)
+		if err != nil {
+			t.Fatalf("%s: failed to render chart. error=%v\n", c.name, err)
+		}
+		installed, err := renderValuesWithCluster(t, "core", values, c.apiVersions, gitopsClusterObjects()...)
+		if err != nil {
+			t.Fatalf("%s: failed to render chart. error=%v\n", c.name, err)
+		}
+		for name := range empty {
+			if empty[name] != installed[name] {
+				t.Errorf("%s: %s depends on the objects of the cluster\n", c.name, name)
+			}
+		}
+	}
+
+	// outside of GitOps mode, the certificates are generated on every render
+	options := &helm.Options{Logger: logger.Discard}
+	first := helm.RenderTemplate(t, options, "../charts/core", nvRel, []string{})
+	second := helm.RenderTemplate(t, options, "../charts/core", nvRel, []string{})
+	if first == second {
+		t.Errorf("Renders without GitOps mode should generate certificates\n")
+	}
+
+	options = &helm.Options{
+		SetValues: map[string]string{"gitops.enabled": "true"},
+		Logger:    logger.Discard,
+	}
+	first = helm.RenderTemplate(t, options, "../charts/crd", nvRel, []string{})
+	second = helm.RenderTemplate(t, options, "../charts/crd", nvRel, []string{})
+	if first != second {
+		t.Errorf("crd: two renders are different\n")
+	}
+}
+
+func TestGitOpsJob(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"gitops.enabled":                  "true",
+			"bootstrapPassword.generate":      "true",
+			"cve.adapter.enabled":             "true",
+			"gitops.job.image.registry":       "registry.example.com",
+			"gitops.job.image.tag":            "16.0",
+			"gitops.job.resources.limits.cpu": "100m",
+			"fullnameOverride":                "nv",
+		},
+		Logger: logger.Discard,
+	}
+	out := helm.RenderTemplate(t, options, "../charts/core", nvRel, []string{})
+	objs, _ := renderObjects(t, "../charts/core", options)
+
+	secrets := []string{"nv-controller-secret", "nv-manager-secret", "nv-registry-adapter-secret", "neuvector-bootstrap-secret"}
+	for _, name := range secrets {
+		if _, ok := objs["Secret/"+name]; ok {
+			t.Errorf("Secret/%s should be created by the gitops Job\n", name)
+		}
+	}
+	for _, name := range []string{"ServiceAccount/nv-gitops", "Role/nv-binding-gitops", "RoleBinding/nv-binding-gitops", "Job/nv-gitops-pod"} {
+		var obj namedObject
+		helm.UnmarshalK8SYaml(t, objs[name], &obj)
+		if obj.Annotations["helm.sh/hook"] != "pre-install,pre-upgrade" {
+			t.Errorf("%s should be a pre-install and pre-upgrade hook. annotations=%v\n", name, obj.Annotations)
+		}
+	}
+
+	var job batchv1.Job
+	helm.UnmarshalK8SYaml(t, objs["Job/nv-gitops-pod"], &job)
+	c := job.Spec.Template.Spec.Containers[0]
+	if c.Image != "registry.example.com/bci/bci-base:16.0" || c.Resources.Limits.Cpu().String() != "100m" {
+		t.Errorf("gitops Job container is wrong. image=%v resources=%+v\n", c.Image, c.Resources)
+	}
+	if job.Spec.Template.Spec.ServiceAccountName != "nv-gitops" {
+		t.Errorf("gitops Job service account is wrong. serviceAccountName=%v\n", job.Spec.Template.Spec.ServiceAccountName)
+	}
+	script := c.Command[len(c.Command)-1]
+	for _, line := range []string{
+		"exists nv-controller-secret || {",
+		"create nv-controller-secret ssl-cert.key key.pem ssl-cert.pem cert.pem",
+		"create nv-manager-secret ssl-cert.key key.pem ssl-cert.pem cert.pem",
+		`-subj /CN=neuvector -addext "subjectAltName=DNS:neuvector,DNS:nv-service-registry-adapter.default.svc.cluster.local,DNS:nv-service-registry-adapter"`,
+		"create neuvector-bootstrap-secret bootstrapPassword password",
+	} {
+		if !strings.Contains(script, line) {
+			t.Errorf("gitops Job script is missing %q\n%s", line, script)
+		}
+	}
+
+	// the Job may only read the secrets it creates
+	matrix := buildRBACMatrix(t, out, "default")
+	var granted []string
+	for _, g := range matrix["default:nv-gitops"] {
+		for _, p := range g.permissions() {
+			granted = append(granted, p.String())
+		}
+	}
+	expected := []string{"create secrets in namespace default"}
+	for _, name := range secrets {
+		expected = append(expected, "get secrets/"+name+" in namespace default")
+	}
+	sort.Strings(granted)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(granted, expected) {
+		t.Errorf("gitops Job permissions are wrong.\ngranted=%v\nexpected=%v\n", granted, expected)
+	}
+
+	// the workloads mount the secrets, without a checksum of their content
+	for _, name := range []string{"Deployment/nv-controller-pod", "Deployment/nv-manager-pod", "Deployment/nv-registry-adapter-pod"} {
+		var w podWorkload
+		helm.UnmarshalK8SYaml(t, objs[name], &w)
+		for key := range w.Spec.Template.Annotations {
+			if strings.HasSuffix(key, "-secret") {
+				t.Errorf("%s: %s should not be rendered\n", name, key)
+			}
+		}
+	}
+}
+
+func TestGitOpsJobImage(t *testing.T) {
+	cases := []struct {
+		values map[string]string
+		image  string
+	}{
+		{map[string]string{}, "registry.suse.com/bci/bci-base:15.6"},
+		{map[string]string{"registry": "mirror.example.com"}, "mirror.example.com/bci/bci-base:15.6"},
+		{map[string]string{"registry": "mirror.example.com", "gitops.job.image.registry": "bci.example.com"}, "bci.example.com/bci/bci-base:15.6"},
+		{map[string]string{"gitops.job.image.hash": "sha256:0123"}, "registry.suse.com/bci/bci-base@sha256:0123"},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: mergeValues(map[string]string{"gitops.enabled": "true"}, c.values),
+			Logger:    logger.Discard,
+		}
+		objs, _ := renderObjects(t, "../charts/core", options)
+
+		var job batchv1.Job
+		helm.UnmarshalK8SYaml(t, objs["Job/neuvector-gitops-pod"], &job)
+		if image := job.Spec.Template.Spec.Containers[0].Image; image != c.image {
+			t.Errorf("gitops Job image is wrong. values=%v image=%v\n", c.values, image)
+		}
+	}
+}
+
+func TestGitOpsJobImagePullSecrets(t *testing.T) {
+	cases := []struct {
+		values   map[string]string
+		expected []string
+	}{
+		{map[string]string{}, nil},
+		{map[string]string{"imagePullSecrets": "regcred"}, []string{"regcred"}},
+		{map[string]string{"imagePullSecrets[0]": "regcred", "imagePullSecrets[1].name": "mirror"}, []string{"regcred", "mirror"}},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: mergeValues(map[string]string{"gitops.enabled": "true", "bootstrapPassword.generate": "true"}, c.values),
+			Logger:    logger.Discard,
+		}
+		objs, _ := renderObjects(t, "../charts/core", options)
+
+		var job batchv1.Job
+		helm.UnmarshalK8SYaml(t, objs["Job/neuvector-gitops-pod"], &job)
+		var names []string
+		for _, s := range job.Spec.Template.Spec.ImagePullSecrets {
+			names = append(names, s.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("gitops Job image pull secrets are wrong. values=%v secrets=%v\n", c.values, names)
+		}
+	}
+}
+
+func TestGitOpsCertificates(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"gitops.enabled":                     "true",
+			"gitops.certificates":                "certmanager",
+			"controller.certificate.key":         "key",
+			"controller.certificate.certificate": "cert",
+			"defaultValidityPeriod":              "30",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+
+	// a certificate of the values is rendered as is, without generated content
+	var secret corev1.Secret
+	helm.UnmarshalK8SYaml(t, objs["Secret/neuvector-controller-secret"], &secret)
+	if string(secret.Data["ssl-cert.key"]) != "key" || string(secret.Data["ssl-cert.pem"]) != "cert" {
+		t.Errorf("Controller certificate is wrong. data=%v\n", secret.Data)
+	}
+	if _, ok := objs["Job/neuvector-gitops-pod"]; ok {
+		t.Errorf("The gitops Job should not be rendered with cert-manager\n")
+	}
+	if _, ok := objs["Certificate/neuvector-controller-secret"]; ok {
+		t.Errorf("The controller certificate of the values should not be issued\n")
+	}
+
+	var cert unstructured.Unstructured
+	helm.UnmarshalK8SYaml(t, objs["Certificate/neuvector-manager-secret"], &cert.Object)
+	secretName, _, _ := unstructured.NestedString(cert.Object, "spec", "secretName")
+	duration, _, _ := unstructured.NestedString(cert.Object, "spec", "duration")
+	issuer, _, _ := unstructured.NestedString(cert.Object, "spec", "issuerRef", "name")
+	if secretName != "neuvector-manager-secret" || duration != "720h" || issuer != "neuvector-gitops-selfsigned" {
+		t.Errorf("Manager certificate is wrong. spec=%v\n", cert.Object["spec"])
+	}
+	if _, ok := objs["Issuer/neuvector-gitops-selfsigned"]; !ok {
+		t.Errorf("The self-signed issuer is not rendered\n")
+	}
+
+	// cert-manager stores tls.key and tls.crt
+	var w podWorkload
+	helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-manager-pod"], &w)
+	mounts := map[string]string{}
+	for _, m := range w.Spec.Template.Spec.Containers[0].VolumeMounts {
+		mounts[m.MountPath] = m.SubPath
+	}
+	if mounts["/etc/neuvector/certs/ssl-cert.key"] != "tls.key" || mounts["/etc/neuvector/certs/ssl-cert.pem"] != "tls.crt" {
+		t.Errorf("Manager certificate mounts are wrong. mounts=%v\n", mounts)
+	}
+	helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-controller-pod"], &w)
+	if _, ok := w.Spec.Template.Annotations["checksum/controller-secret"]; !ok {
+		t.Errorf("The checksum of the controller certificate of the values should be rendered\n")
+	}
+}
+
+func TestGitOpsSyncWaves(t *testing.T) {
+	waves := func(objs map[string]string) map[string]string {
+		result := make(map[string]string)
+		for name, doc := range objs {
+			var obj namedObject
+			helm.UnmarshalK8SYaml(t, doc, &obj)
+			if wave, ok := obj.Annotations["argocd.argoproj.io/sync-wave"]; ok {
+				result[name] = wave
+			}
+		}
+		return result
+	}
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"gitops.enabled":               "true",
+			"gitops.syncWaves.workloads":   "5",
+			"controller.annotations.owner": "security",
+			"controller.secret.enabled":    "true",
+			"controller.configmap.enabled": "true",
+			"bootstrapPassword.value":      "password",
+			"bootstrapPassword.keep":       "true",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+	expected := map[string]string{
+		"Secret/neuvector-internal-certs":     "-1",
+		"Secret/neuvector-init":               "-1",
+		"ConfigMap/neuvector-init":            "-1",
+		"Secret/neuvector-bootstrap-secret":   "-1",
+		"Deployment/neuvector-controller-pod": "5",
+		"DaemonSet/neuvector-enforcer-pod":    "5",
+		"Deployment/neuvector-manager-pod":    "5",
+		"Deployment/neuvector-scanner-pod":    "5",
+		"CronJob/neuvector-updater-pod":       "5",
+		"CronJob/neuvector-cert-upgrader-pod": "5",
+	}
+	for name := range objs {
+		if strings.HasPrefix(name, "CustomResourceDefinition/") {
+			expected[name] = "-2"
+		}
+	}
+	if actual := waves(objs); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Sync waves are wrong.\nactual=%v\nexpected=%v\n", actual, expected)
+	}
+
+	// the annotations of the values are kept
+	var obj namedObject
+	helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-controller-pod"], &obj)
+	if obj.Annotations["owner"] != "security" {
+		t.Errorf("Controller annotations are wrong. annotations=%v\n", obj.Annotations)
+	}
+	helm.UnmarshalK8SYaml(t, objs["Secret/neuvector-bootstrap-secret"], &obj)
+	if obj.Annotations["helm.sh/resource-policy"] != "keep" {
+		t.Errorf("Bootstrap secret annotations are wrong. annotations=%v\n", obj.Annotations)
+	}
+	helm.UnmarshalK8SYaml(t, objs["CronJob/neuvector-cert-upgrader-pod"], &obj)
+	if _, ok := obj.Annotations["cert-upgrader-uid"]; !ok {
+		t.Errorf("Cert upgrader annotations are wrong. annotations=%v\n", obj.Annotations)
+	}
+
+	options = &helm.Options{
+		SetValues: map[string]string{"gitops.enabled": "true"},
+		Logger:    logger.Discard,
+	}
+	objs, _ = renderObjects(t, "../charts/crd", options)
+	for name, wave := range waves(objs) {
+		if wave != "-2" {
+			t.Errorf("crd: sync wave of %s is wrong. wave=%v\n", name, wave)
+		}
+	}
+	if len(waves(objs)) != len(objs) {
+		t.Errorf("crd: every CRD should have a sync wave\n")
+	}
+
+	// no sync waves outside of GitOps mode
+	for _, chart := range []string{"core", "crd"} {
+		objs, _ = renderObjects(t, "../charts/"+chart, &helm.Options{Logger: logger.Discard})
+		if actual := waves(objs); len(actual) != 0 {
+			t.Errorf("%s: sync waves should not be rendered. waves=%v\n", chart, actual)
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package test
 
 import (
+	"regexp"
 	"strings"
 )
 
 const nvRel = "nv"
 
+// yamlSeparator matches document separators only, so PEM blocks in the output are kept intact.
+var yamlSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
 func splitYaml(out string) []string {
 	outputs := make([]string, 0)
 
-	outs := strings.Split(out, "---")
+	outs := yamlSeparator.Split(out, -1)
 	for _, out := range outs {
 		out := strings.TrimSpace(out)
 
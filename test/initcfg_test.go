@@ -0,0 +1,287 @@
+package test
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// initcfgFixture is a scenario in fixtures/initcfg/*.yaml: the controller.initcfg values, the
+// secrets their secretKeyRefs point to, and the files expected in the neuvector-init secret.
+type initcfgFixture struct {
+	Secrets    map[string]map[string]string `json:"secrets"`
+	Values     map[string]interface{}       `json:"values"`
+	Federation map[string]interface{}       `json:"federation"`
+	Expected   map[string]interface{}       `json:"expected"`
+}
+
+func (f *initcfgFixture) secrets() []corev1.Secret {
+	var secrets []corev1.Secret
+	for name, data := range f.Secrets {
+		secret := corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "neuvector"},
+			Data:       make(map[string][]byte),
+		}
+		for k, v := range data {
+			secret.Data[k] = []byte(v)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+// initSecretFiles decodes the files of the neuvector-init secret.
+func initSecretFiles(t *testing.T, out map[string]string) map[string]interface{} {
+	var secret corev1.Secret
+	helm.UnmarshalK8SYaml(t, out["core/templates/init-secret.yaml"], &secret)
+
+	files := make(map[string]interface{})
+	for name, data := range secret.Data {
+		var content interface{}
+		if err := yaml.Unmarshal(data, &content); err != nil {
+			t.Fatalf("Failed to parse %s. error=%v\n%s", name, err, data)
+		}
+		files[name] = content
+	}
+	return files
+}
+
+// resolveInitFiles runs the script of the init-config init container of the controller on the
+// files of the neuvector-init secret, with the secret keys of its environment, and decodes the
+// files it writes. Without the init container, the files of the secret are returned.
+func resolveInitFiles(t *testing.T, out map[string]string, secrets ...corev1.Secret) map[string]interface{} {
+	var dep appsv1.Deployment
+	helm.UnmarshalK8SYaml(t, out["core/templates/controller-deployment.yaml"], &dep)
+	var init *corev1.Container
+	for i, c := range dep.Spec.Template.Spec.InitContainers {
+		if c.Name == "init-config" {
+			init = &dep.Spec.Template.Spec.InitContainers[i]
+		}
+	}
+	if init == nil {
+		return initSecretFiles(t, out)
+	}
+
+	var secret corev1.Secret
+	helm.UnmarshalK8SYaml(t, out["core/templates/init-secret.yaml"], &secret)
+	src, dst := t.TempDir(), t.TempDir()
+	for name, data := range secret.Data {
+		if err := os.WriteFile(filepath.Join(src, name), data, 0600); err != nil {
+			t.Fatalf("Failed to write %s. error=%v\n", name, err)
+		}
+	}
+
+	// the environment the kubelet sets from the secrets
+	env := []string{"PATH=" + os.Getenv("PATH")}
+	for _, e := range init.Env {
+		ref := e.ValueFrom.SecretKeyRef
+		found := false
+		for _, s := range secrets {
+			if value, ok := s.Data[ref.Key]; ok && s.Name == ref.Name {
+				env = append(env, e.Name+"="+string(value))
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Key %s of secret %s is not found\n", ref.Key, ref.Name)
+		}
+	}
+
+	script := strings.NewReplacer("src=/etc/neuvector/initcfg", "src="+src, "dst=/etc/config", "dst="+dst).Replace(init.Command[2])
+	cmd := exec.Command(init.Command[0], init.Command[1], script)
+	cmd.Env = env
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to run the init-config script. error=%v\n%s", err, output)
+	}
+
+	files := make(map[string]interface{})
+	for name := range secret.Data {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s. error=%v\n", name, err)
+		}
+		var content interface{}
+		if err := yaml.Unmarshal(data, &content); err != nil {
+			t.Fatalf("Failed to parse %s. error=%v\n%s", name, err, data)
+		}
+		files[name] = content
+	}
+	return files
+}
+
+func TestInitConfigFixtures(t *testing.T) {
+	paths, err := filepath.Glob("fixtures/initcfg/*.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No init config fixtures found. error=%v\n", err)
+	}
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".yaml")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read fixture. file=%v error=%v\n", path, err)
+		}
+		var fixture initcfgFixture
+		if err := yaml.UnmarshalStrict(data, &fixture); err != nil {
+			t.Fatalf("Failed to parse fixture. file=%v error=%v\n", path, err)
+		}
+
+		controller := map[string]interface{}{"initcfg": fixture.Values}
+		if fixture.Federation != nil {
+			controller["federation"] = fixture.Federation
+		}
+		out, err := renderValuesWithSecrets(t, "core", map[string]interface{}{"controller": controller}, fixture.secrets()...)
+		if err != nil {
+			t.Errorf("%s: failed to render chart. error=%v\n", name, err)
+			continue
+		}
+
+		// the secret keys are read by the controller pod, not rendered
+		for secret, data := range fixture.Secrets {
+			for key, value := range data {
+				for file, content := range out {
+					if strings.Contains(content, value) {
+						t.Errorf("%s: key %s of secret %s is rendered in %s\n", name, key, secret, file)
+					}
+				}
+			}
+		}
+
+		files := resolveInitFiles(t, out, fixture.secrets()...)
+		var actualNames, expectedNames []string
+		for file := range files {
+			actualNames = append(actualNames, file)
+		}
+		for file := range fixture.Expected {
+			expectedNames = append(expectedNames, file)
+		}
+		sort.Strings(actualNames)
+		sort.Strings(expectedNames)
+		if strings.Join(actualNames, ",") != strings.Join(expectedNames, ",") {
+			t.Errorf("%s: unexpected init files. expected=%v actual=%v\n", name, expectedNames, actualNames)
+			continue
+		}
+
+		for file, expected := range fixture.Expected {
+			want, _ := json.Marshal(expected)
+			actual, _ := json.Marshal(files[file])
+			if string(want) != string(actual) {
+				t.Errorf("%s: %s is wrong.\nexpected: %s\nactual:   %s\n", name, file, want, actual)
+			}
+		}
+	}
+}
+
+func TestInitConfigDefault(t *testing.T) {
+	out, err := renderWithSecrets(t, "core", map[string]string{})
+	if err != nil {
+		t.Fatalf("Failed to render chart. error=%v\n", err)
+	}
+	if secret, ok := out["core/templates/init-secret.yaml"]; ok && strings.TrimSpace(secret) != "" {
+		t.Errorf("The init secret should not be rendered by default.\n%s", secret)
+	}
+}
+
+func TestInitConfigSecretData(t *testing.T) {
+	values := map[string]string{
+		"controller.secret.enabled":                          "true",
+		"controller.initcfg.sys.Cluster_Name":                "prod",
+		"controller.initcfg.sys.New_Service_Policy_Mode":     "Protect",
+		"controller.initcfg.role.roles[0].Name":              "auditor",
+		"controller.initcfg.role.roles[0].Permissions[0].id": "audit_events",
+	}
+
+	out, err := renderWithSecrets(t, "core", values)
+	if err != nil {
+		t.Fatalf("Failed to render chart. error=%v\n", err)
+	}
+	files := initSecretFiles(t, out)
+	for _, file := range []string{"userinitcfg.yaml", "sysinitcfg.yaml", "roleinitcfg.yaml"} {
+		if _, ok := files[file]; !ok {
+			t.Errorf("%s is missing from the init secret. files=%v\n", file, files)
+		}
+	}
+}
+
+func TestInitConfigErrors(t *testing.T) {
+	ldap := map[string]string{
+		"controller.initcfg.ldap.directory": "OpenLDAP",
+		"controller.initcfg.ldap.Hostname":  "ldap.example.com",
+		"controller.initcfg.ldap.base_dn":   "dc=org",
+	}
+
+	cases := []struct {
+		name   string
+		values map[string]string
+		err    string
+	}{
+		{
+			name:   "typo",
+			values: map[string]string{"controller.initcfg.ldap.hostname": "ldap.example.com"},
+			err:    "/controller/initcfg/ldap",
+		},
+		{
+			name:   "required field",
+			values: map[string]string{"controller.initcfg.oidc.Issuer": "https://idp.example.com", "controller.initcfg.oidc.Client_ID": "neuvector"},
+			err:    "missing property 'Client_Secret'",
+		},
+		{
+			name:   "enum",
+			values: map[string]string{"controller.initcfg.sys.New_Service_Policy_Mode": "Enforce"},
+			err:    "at '/controller/initcfg/sys/New_Service_Policy_Mode': value must be one of 'Discover', 'Monitor', 'Protect'",
+		},
+		{
+			name:   "directory",
+			values: map[string]string{"controller.initcfg.ldap.directory": "AD", "controller.initcfg.ldap.Hostname": "ldap", "controller.initcfg.ldap.base_dn": "dc=org"},
+			err:    "at '/controller/initcfg/ldap/directory'",
+		},
+		{
+			name:   "incomplete secretKeyRef",
+			values: map[string]string{"controller.initcfg.user.users[0].Fullname": "admin", "controller.initcfg.user.users[0].Password.secretKeyRef.name": "neuvector-admin"},
+			err:    "/controller/initcfg/user/users/0/Password",
+		},
+		{
+			name: "same file in the configmap",
+			values: mergeValues(ldap, map[string]string{
+				"controller.configmap.enabled":                 "true",
+				"controller.configmap.data.ldapinitcfg\\.yaml": "directory: OpenLDAP",
+			}),
+			err: "controller.configmap.data.ldapinitcfg.yaml cannot be set with controller.initcfg.ldap",
+		},
+		{
+			name: "same file in the secret",
+			values: map[string]string{
+				"controller.secret.enabled":                 "true",
+				"controller.initcfg.user.users[0].Fullname": "admin",
+			},
+			err: "controller.secret.data.userinitcfg.yaml cannot be set with controller.initcfg.user",
+		},
+	}
+
+	for _, c := range cases {
+		_, err := renderWithSecrets(t, "core", c.values)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: unexpected error. expected=%v actual=%v\n", c.name, c.err, err)
+		}
+	}
+}
+
+func mergeValues(maps ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
@@ -0,0 +1,376 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"k8s.io/apimachinery/pkg/util/version"
+	"sigs.k8s.io/yaml"
+)
+
+// kubeVersionValues enable the templates that choose their API version by Kubernetes version.
+var kubeVersionValues = map[string]string{
+	"psp":                                             "true",
+	"controller.disruptionbudget":                     "1",
+	"controller.ingress.enabled":                      "true",
+	"controller.federation.mastersvc.type":            "ClusterIP",
+	"controller.federation.mastersvc.ingress.enabled": "true",
+	"manager.ingress.enabled":                         "true",
+	"cve.adapter.enabled":                             "true",
+	"cve.adapter.ingress.enabled":                     "true",
+	"cve.adapter.route.enabled":                       "true",
+	"global.aws.enabled":                              "true",
+}
+
+var openshiftAPIVersions = []string{"route.openshift.io/v1", "security.openshift.io/v1"}
+
+// kubeVersionCase is a cluster of the supported version matrix, with the API version chosen for
+// each kind by the templates that support several.
+type kubeVersionCase struct {
+	name        string
+	kubeVersion string
+	apiVersions []string
+	expected    map[string]string
+}
+
+func rbacAPIVersions(apiVersion string) map[string]string {
+	return map[string]string{
+		"ClusterRole":        apiVersion,
+		"ClusterRoleBinding": apiVersion,
+		"Role":               apiVersion,
+		"RoleBinding":        apiVersion,
+	}
+}
+
+// withAPIVersions returns the API versions of a cluster, with the changes of a newer version.
+func withAPIVersions(base map[string]string, changes ...map[string]string) map[string]string {
+	expected := make(map[string]string)
+	for k, v := range base {
+		expected[k] = v
+	}
+	for _, apiVersions := range changes {
+		for k, v := range apiVersions {
+			expected[k] = v
+		}
+	}
+	return expected
+}
+
+var (
+	kube107 = withAPIVersions(rbacAPIVersions("v1"), map[string]string{
+		"Deployment":               "extensions/v1beta1",
+		"DaemonSet":                "extensions/v1beta1",
+		"CronJob":                  "batch/v2alpha1",
+		"PodDisruptionBudget":      "policy/v1beta1",
+		"CustomResourceDefinition": "apiextensions.k8s.io/v1beta1",
+		"Ingress":                  "extensions/v1beta1",
+	})
+	kube108 = withAPIVersions(kube107, rbacAPIVersions("rbac.authorization.k8s.io/v1"), map[string]string{
+		"CronJob": "batch/v1beta1",
+	})
+	kube109 = withAPIVersions(kube108, map[string]string{
+		"Deployment": "apps/v1",
+		"DaemonSet":  "apps/v1",
+	})
+	kube119 = withAPIVersions(kube109, map[string]string{
+		"CustomResourceDefinition": "apiextensions.k8s.io/v1",
+		"Ingress":                  "networking.k8s.io/v1",
+	})
+	kube121 = withAPIVersions(kube119, map[string]string{
+		"CronJob":             "batch/v1",
+		"PodDisruptionBudget": "policy/v1",
+	})
+)
+
+var kubeVersionMatrix = []kubeVersionCase{
+	{name: "Kubernetes 1.7", kubeVersion: "1.7.0", expected: kube107},
+	{name: "Kubernetes 1.8", kubeVersion: "1.8.0", expected: kube108},
+	{name: "Kubernetes 1.9", kubeVersion: "1.9.0", expected: kube109},
+	{name: "OpenShift 3.11", kubeVersion: "1.11.0", apiVersions: openshiftAPIVersions, expected: withAPIVersions(kube109, rbacAPIVersions("authorization.openshift.io/v1"))},
+	{name: "OpenShift 4.1", kubeVersion: "1.13.0", apiVersions: openshiftAPIVersions, expected: kube109},
+	{name: "Kubernetes 1.18", kubeVersion: "1.18.0", expected: kube109},
+	{name: "Kubernetes 1.19", kubeVersion: "1.19.0", expected: kube119},
+	{name: "Kubernetes 1.21", kubeVersion: "1.21.0", expected: kube121},
+	{name: "Kubernetes 1.24", kubeVersion: "1.24.0", expected: kube121},
+	{name: "Kubernetes 1.25", kubeVersion: "1.25.0", expected: kube121},
+	{name: "Kubernetes 1.33", kubeVersion: "1.33.0", expected: kube121},
+	{name: "OpenShift 4.20", kubeVersion: "1.33.0", apiVersions: openshiftAPIVersions, expected: kube121},
+}
+
+// renderedObject is an object rendered by a template.
+type renderedObject struct {
+	template string
+	obj      map[string]interface{}
+}
+
+func (o renderedObject) apiVersion() string {
+	v, _ := o.obj["apiVersion"].(string)
+	return v
+}
+
+func (o renderedObject) kind() string {
+	v, _ := o.obj["kind"].(string)
+	return v
+}
+
+func (o renderedObject) name() string {
+	metadata, _ := o.obj["metadata"].(map[string]interface{})
+	v, _ := metadata["name"].(string)
+	return v
+}
+
+var sourceComment = regexp.MustCompile(`(?m)^# Source: (\S+)$`)
+
+// renderKubeVersion renders a chart in a cluster of the matrix, in both RBAC modes of the core chart.
+func renderKubeVersion(t *testing.T, chart string, c kubeVersionCase) []renderedObject {
+	args := []string{"--kube-version", c.kubeVersion}
+	for _, api := range c.apiVersions {
+		args = append(args, "--api-versions", api)
+	}
+
+	// the core chart is rendered in both RBAC modes
+	sets := []map[string]string{nil}
+	if chart == "core" {
+		sets = []map[string]string{
+			mergeValues(kubeVersionValues, map[string]string{"leastPrivilege": "false"}),
+			mergeValues(kubeVersionValues, map[string]string{"leastPrivilege": "true"}),
+		}
+	}
+
+	var objs []renderedObject
+	for _, values := range sets {
+		options := &helm.Options{SetValues: values, Logger: logger.Discard}
+		out, err := helm.RenderTemplateE(t, options, "../charts/"+chart, nvRel, []string{}, args...)
+		if err != nil {
+			t.Fatalf("%s: failed to render %s chart. error=%v\n", c.name, chart, err)
+		}
+		for _, doc := range strings.Split(out, "\n---\n") {
+			source := sourceComment.FindStringSubmatch(doc)
+			if source == nil {
+				continue
+			}
+			var obj map[string]interface{}
+			if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+				t.Fatalf("%s: failed to parse manifest. error=%v\n%s", c.name, err, doc)
+			}
+			if obj != nil {
+				objs = append(objs, renderedObject{template: source[1], obj: obj})
+			}
+		}
+	}
+	return objs
+}
+
+var (
+	templateAPIVersion = regexp.MustCompile(`^apiVersion: (\S+)$`)
+	templateKind       = regexp.MustCompile(`^kind: (\w+)$`)
+)
+
+// templateAPIVersions returns the API versions written in the templates of a chart for each kind,
+// by template, e.g. core/templates/crd.yaml.
+func templateAPIVersions(t *testing.T, chart string) map[string]map[string][]string {
+	paths, err := filepath.Glob(filepath.Join("..", "charts", chart, "templates", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to list templates. chart=%v error=%v\n", chart, err)
+	}
+
+	templates := make(map[string]map[string][]string)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read template. file=%v error=%v\n", path, err)
+		}
+		kinds := make(map[string][]string)
+		var pending []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if m := templateAPIVersion.FindStringSubmatch(line); m != nil {
+				pending = append(pending, m[1])
+			} else if m := templateKind.FindStringSubmatch(line); m != nil && len(pending) > 0 {
+				for _, v := range pending {
+					if !contains(kinds[m[1]], v) {
+						kinds[m[1]] = append(kinds[m[1]], v)
+					}
+				}
+				pending = nil
+			}
+		}
+		templates[filepath.Join(chart, "templates", filepath.Base(path))] = kinds
+	}
+	return templates
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// TestKubeVersionMatrix renders the charts in each cluster of the matrix and checks the API version
+// chosen by the templates that support several for a kind. A branch that no cluster of the matrix
+// renders is reported, so that it can be removed when the oldest supported version moves.
+func TestKubeVersionMatrix(t *testing.T) {
+	for _, chart := range snapshotCharts {
+		sources := templateAPIVersions(t, chart)
+		rendered := make(map[string]map[string]bool)
+
+		for _, c := range kubeVersionMatrix {
+			for _, o := range renderKubeVersion(t, chart, c) {
+				key := o.template + " " + o.kind()
+				if rendered[key] == nil {
+					rendered[key] = make(map[string]bool)
+				}
+				rendered[key][o.apiVersion()] = true
+
+				if len(sources[o.template][o.kind()]) < 2 {
+					continue
+				}
+				if expected := c.expected[o.kind()]; o.apiVersion() != expected {
+					t.Errorf("%s: %s %s uses %s, expected %s\n", c.name, o.kind(), o.name(), o.apiVersion(), expected)
+				}
+				for _, err := range checkAPIShape(o) {
+					t.Errorf("%s: %s %s/%s: %s\n", c.name, o.template, o.kind(), o.name(), err)
+				}
+			}
+		}
+
+		var dead []string
+		for template, kinds := range sources {
+			for kind, apiVersions := range kinds {
+				if len(apiVersions) < 2 {
+					continue
+				}
+				for _, v := range apiVersions {
+					if !rendered[template+" "+kind][v] {
+						dead = append(dead, fmt.Sprintf("%s: %s %s", template, kind, v))
+					}
+				}
+			}
+		}
+		sort.Strings(dead)
+		for _, d := range dead {
+			t.Errorf("No cluster of the version matrix renders %s, add the cluster or remove the branch\n", d)
+		}
+	}
+}
+
+// checkAPIShape checks the fields that differ between the API versions of a kind.
+func checkAPIShape(o renderedObject) []string {
+	var errs []string
+	spec, _ := o.obj["spec"].(map[string]interface{})
+
+	switch o.kind() {
+	case "CustomResourceDefinition":
+		versions, _ := spec["versions"].([]interface{})
+		if len(versions) == 0 {
+			return []string{"no versions"}
+		}
+		for _, v := range versions {
+			version, _ := v.(map[string]interface{})
+			_, hasSchema := fieldValue(version, "schema.openAPIV3Schema")
+			if o.apiVersion() == "apiextensions.k8s.io/v1" && !hasSchema {
+				errs = append(errs, fmt.Sprintf("version %v has no schema", version["name"]))
+			}
+		}
+		first, _ := versions[0].(map[string]interface{})
+		if o.apiVersion() == "apiextensions.k8s.io/v1beta1" && spec["version"] != first["name"] {
+			errs = append(errs, fmt.Sprintf("spec.version %v is not the first version %v", spec["version"], first["name"]))
+		}
+		if o.apiVersion() == "apiextensions.k8s.io/v1" && spec["version"] != nil {
+			errs = append(errs, "spec.version is not served by apiextensions.k8s.io/v1")
+		}
+
+	case "Deployment", "DaemonSet":
+		selector, _ := fieldValue(o.obj, "spec.selector.matchLabels")
+		labels, _ := fieldValue(o.obj, "spec.template.metadata.labels")
+		selectorLabels, _ := selector.(map[string]interface{})
+		podLabels, _ := labels.(map[string]interface{})
+		if len(selectorLabels) == 0 {
+			errs = append(errs, "no selector")
+		}
+		for k, v := range selectorLabels {
+			if podLabels[k] != v {
+				errs = append(errs, fmt.Sprintf("selector %s=%v does not match the pod labels", k, v))
+			}
+		}
+
+	case "CronJob":
+		containers, _ := fieldValue(o.obj, "spec.jobTemplate.spec.template.spec.containers")
+		if list, _ := containers.([]interface{}); spec["schedule"] == nil || len(list) == 0 {
+			errs = append(errs, "no schedule or job template")
+		}
+
+	case "PodDisruptionBudget":
+		if _, ok := fieldValue(o.obj, "spec.selector.matchLabels"); !ok || spec["minAvailable"] == nil {
+			errs = append(errs, "no selector or minAvailable")
+		}
+
+	case "Ingress":
+		rules, _ := spec["rules"].([]interface{})
+		for _, r := range rules {
+			paths, _ := fieldValue(r.(map[string]interface{}), "http.paths")
+			for _, p := range paths.([]interface{}) {
+				path := p.(map[string]interface{})
+				_, v1 := fieldValue(path, "backend.service.name")
+				_, v1beta1 := fieldValue(path, "backend.serviceName")
+				if o.apiVersion() == "networking.k8s.io/v1" && (!v1 || path["pathType"] == nil) {
+					errs = append(errs, "path without backend.service or pathType")
+				}
+				if o.apiVersion() == "extensions/v1beta1" && !v1beta1 {
+					errs = append(errs, "path without backend.serviceName")
+				}
+			}
+		}
+
+	case "ClusterRoleBinding", "RoleBinding":
+		roleRef, _ := o.obj["roleRef"].(map[string]interface{})
+		if o.apiVersion() == "authorization.openshift.io/v1" {
+			if roleRef["apiGroup"] != nil || roleRef["name"] == nil {
+				errs = append(errs, fmt.Sprintf("OpenShift 3 roleRef takes no apiGroup. roleRef=%v", roleRef))
+			}
+		} else if roleRef["apiGroup"] != "rbac.authorization.k8s.io" || roleRef["kind"] == nil {
+			errs = append(errs, fmt.Sprintf("roleRef is wrong. roleRef=%v", roleRef))
+		}
+	}
+	return errs
+}
+
+// TestKubeVersionLegacyBranches checks the objects that only exist on some versions of the matrix,
+// and the Kubernetes API called by the updater to restart the scanner.
+func TestKubeVersionLegacyBranches(t *testing.T) {
+	for _, c := range kubeVersionMatrix {
+		kubeVersion := version.MustParseGeneric(c.kubeVersion)
+
+		psp := false
+		for _, o := range renderKubeVersion(t, "core", c) {
+			switch {
+			case o.kind() == "PodSecurityPolicy":
+				psp = true
+			case o.kind() == "CronJob" && o.name() == "neuvector-updater-pod":
+				containers, _ := fieldValue(o.obj, "spec.jobTemplate.spec.template.spec.containers")
+				command := fmt.Sprint(containers)
+				expected := "/apis/apps/v1/namespaces/default/deployments/neuvector-scanner-pod"
+				if kubeVersion.LessThan(version.MustParseGeneric("1.9.0")) {
+					expected = "/apis/extensions/v1beta1/namespaces/default/deployments/neuvector-scanner-pod"
+				}
+				if !strings.Contains(command, expected) {
+					t.Errorf("%s: updater does not restart the scanner with %s. command=%s\n", c.name, expected, command)
+				}
+			}
+		}
+
+		// PodSecurityPolicies are removed in Kubernetes 1.25
+		if expected := kubeVersion.LessThan(version.MustParseGeneric("1.25.0")); psp != expected {
+			t.Errorf("%s: PodSecurityPolicy rendered=%v, expected %v\n", c.name, psp, expected)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type namedObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+}
+
+// renderObjects renders the whole chart and indexes the objects by "Kind/name".
+func renderObjects(t *testing.T, helmChartPath string, options *helm.Options, extraArgs ...string) (map[string]string, []string) {
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{}, extraArgs...)
+	outs := splitYaml(out)
+
+	objs := make(map[string]string)
+	for _, output := range outs {
+		var obj namedObject
+		helm.UnmarshalK8SYaml(t, output, &obj)
+		objs[obj.Kind+"/"+obj.Name] = output
+	}
+	return objs, outs
+}
+
+func checkPodReferences(t *testing.T, objs map[string]string, owner string, spec corev1.PodSpec, joinAddr string) {
+	for _, c := range spec.Containers {
+		for _, env := range c.Env {
+			switch env.Name {
+			case "CLUSTER_JOIN_ADDR", "CTRL_SERVER_IP":
+				if env.Value != joinAddr {
+					t.Errorf("%s: %s is wrong. value=%v\n", owner, env.Name, env.Value)
+				}
+			}
+		}
+	}
+	for _, v := range spec.Volumes {
+		if v.Secret != nil && v.Secret.SecretName != "neuvector-internal-certs" {
+			if _, ok := objs["Secret/"+v.Secret.SecretName]; !ok {
+				t.Errorf("%s: secret volume %v is not rendered\n", owner, v.Secret.SecretName)
+			}
+		}
+		if v.PersistentVolumeClaim != nil {
+			if _, ok := objs["PersistentVolumeClaim/"+v.PersistentVolumeClaim.ClaimName]; !ok {
+				t.Errorf("%s: claim %v is not rendered\n", owner, v.PersistentVolumeClaim.ClaimName)
+			}
+		}
+		if v.Projected != nil {
+			for _, src := range v.Projected.Sources {
+				if src.ConfigMap != nil {
+					if _, ok := objs["ConfigMap/"+src.ConfigMap.Name]; !ok {
+						t.Errorf("%s: configmap %v is not rendered\n", owner, src.ConfigMap.Name)
+					}
+				}
+				if src.Secret != nil && src.Secret.Name != "neuvector-secret" {
+					if _, ok := objs["Secret/"+src.Secret.Name]; !ok {
+						t.Errorf("%s: secret %v is not rendered\n", owner, src.Secret.Name)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDefaultNames(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"cve.adapter.enabled": "true",
+		},
+	}
+
+	objs, _ := renderObjects(t, helmChartPath, options)
+	for _, name := range []string{
+		"Deployment/neuvector-controller-pod",
+		"Deployment/neuvector-manager-pod",
+		"Deployment/neuvector-scanner-pod",
+		"Deployment/neuvector-registry-adapter-pod",
+		"DaemonSet/neuvector-enforcer-pod",
+		"CronJob/neuvector-updater-pod",
+		"Service/neuvector-svc-controller",
+		"Service/neuvector-service-webui",
+		"Service/neuvector-service-registry-adapter",
+		"Secret/neuvector-controller-secret",
+		"Secret/neuvector-manager-secret",
+	} {
+		if _, ok := objs[name]; !ok {
+			t.Errorf("Object is missing. name=%v\n", name)
+		}
+	}
+}
+
+func TestFullnameOverrideReferences(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"fullnameOverride":                                 "acme",
+			"clusterDomain":                                    "cluster.local",
+			"cve.adapter.enabled":                              "true",
+			"cve.adapter.ingress.enabled":                      "true",
+			"controller.pvc.enabled":                           "true",
+			"controller.configmap.enabled":                     "true",
+			"controller.secret.enabled":                        "true",
+			"controller.apisvc.type":                           "ClusterIP",
+			"controller.apisvc.route.enabled":                  "true",
+			"controller.ingress.enabled":                       "true",
+			"controller.federation.mastersvc.type":             "ClusterIP",
+			"controller.federation.mastersvc.ingress.enabled":  "true",
+			"controller.federation.managedsvc.type":            "ClusterIP",
+			"controller.federation.managedsvc.ingress.enabled": "true",
+			"manager.ingress.enabled":                          "true",
+			"manager.route.enabled":                            "true",
+		},
+	}
+
+	objs, _ := renderObjects(t, helmChartPath, options, "--api-versions", "route.openshift.io/v1")
+
+	joinAddr := "acme-svc-controller.default.svc.cluster.local"
+	if _, ok := objs["Service/acme-svc-controller"]; !ok {
+		t.Errorf("Controller service is not renamed\n")
+	}
+
+	for name, output := range objs {
+		// RBAC objects, leases, webhook services and the cert upgrader keep their names
+		kind := strings.SplitN(name, "/", 2)[0]
+		switch kind {
+		case "Deployment", "DaemonSet", "Service", "Ingress", "Route", "PersistentVolumeClaim":
+			if strings.Contains(name, "/neuvector-") && !strings.Contains(name, "webhook") &&
+				!strings.Contains(name, "cert-upgrader") {
+				t.Errorf("Object is not renamed. name=%v\n", name)
+			}
+		}
+
+		switch kind {
+		case "Deployment":
+			var dep appsv1.Deployment
+			helm.UnmarshalK8SYaml(t, output, &dep)
+			checkPodReferences(t, objs, name, dep.Spec.Template.Spec, joinAddr)
+		case "DaemonSet":
+			var ds appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, output, &ds)
+			checkPodReferences(t, objs, name, ds.Spec.Template.Spec, joinAddr)
+		case "CronJob":
+			if name != "CronJob/acme-updater-pod" {
+				continue
+			}
+			var cron batchv1.CronJob
+			helm.UnmarshalK8SYaml(t, output, &cron)
+			cmd := strings.Join(cron.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Command, " ")
+			if !strings.Contains(cmd, "/deployments/acme-scanner-pod'") {
+				t.Errorf("Updater patches the wrong deployment. command=%v\n", cmd)
+			}
+			if _, ok := objs["Deployment/acme-scanner-pod"]; !ok {
+				t.Errorf("Scanner deployment is not renamed\n")
+			}
+		case "Ingress":
+			var ing netv1.Ingress
+			helm.UnmarshalK8SYaml(t, output, &ing)
+			for _, rule := range ing.Spec.Rules {
+				for _, path := range rule.HTTP.Paths {
+					if _, ok := objs["Service/"+path.Backend.Service.Name]; !ok {
+						t.Errorf("%s: backend service %v is not rendered\n", name, path.Backend.Service.Name)
+					}
+				}
+			}
+		case "Route":
+			var r struct {
+				Spec struct {
+					To struct {
+						Name string `json:"name"`
+					} `json:"to"`
+				} `json:"spec"`
+			}
+			helm.UnmarshalK8SYaml(t, output, &r)
+			if _, ok := objs["Service/"+r.Spec.To.Name]; !ok {
+				t.Errorf("%s: route service %v is not rendered\n", name, r.Spec.To.Name)
+			}
+		}
+	}
+}
+
+func TestMonitorFullnameOverride(t *testing.T) {
+	helmChartPath := "../charts/monitor"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"fullnameOverride": "acme",
+		},
+	}
+
+	objs, _ := renderObjects(t, helmChartPath, options)
+
+	output, ok := objs["Deployment/acme-prometheus-exporter-pod"]
+	if !ok {
+		t.Fatalf("Exporter deployment is not renamed\n")
+	}
+
+	var dep appsv1.Deployment
+	helm.UnmarshalK8SYaml(t, output, &dep)
+	container := dep.Spec.Template.Spec.Containers[0]
+	if len(container.EnvFrom) != 1 || container.EnvFrom[0].SecretRef == nil {
+		t.Fatalf("Exporter should read the credentials from a secret. envFrom=%+v\n", container.EnvFrom)
+	}
+	if _, ok := objs["Secret/"+container.EnvFrom[0].SecretRef.Name]; !ok {
+		t.Errorf("Exporter secret %v is not rendered\n", container.EnvFrom[0].SecretRef.Name)
+	}
+	for _, env := range container.Env {
+		if env.Name == "CTRL_API_SERVICE" && env.Value != "acme-svc-controller-api:10443" {
+			t.Errorf("Controller API service doesn't follow the fullname. value=%v\n", env.Value)
+		}
+	}
+	if _, ok := objs["Service/acme-prometheus-exporter"]; !ok {
+		t.Errorf("Exporter service is not renamed\n")
+	}
+}
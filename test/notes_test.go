@@ -0,0 +1,328 @@
+package test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"helm.sh/helm/v3/pkg/strvals"
+)
+
+// renderNotes renders NOTES.txt the way a client-side dry-run install does, since helm
+// template leaves it out.
+func renderNotes(t *testing.T, chart string, setValues map[string]string, apiVersions ...string) string {
+	values := make(map[string]interface{})
+	for k, v := range setValues {
+		if err := strvals.ParseInto(k+"="+v, values); err != nil {
+			t.Fatalf("Failed to parse value. key=%v error=%v\n", k, err)
+		}
+	}
+
+	chrt, err := loader.Load("../charts/" + chart)
+	if err != nil {
+		t.Fatalf("Failed to load chart. chart=%v error=%v\n", chart, err)
+	}
+
+	cfg := &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   &kubefake.PrintingKubeClient{Out: io.Discard},
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(string, ...interface{}) {},
+	}
+	client := action.NewInstall(cfg)
+	client.ClientOnly = true
+	client.DryRun = true
+	client.ReleaseName = nvRel
+	client.Namespace = "neuvector"
+	client.APIVersions = chartutil.VersionSet(apiVersions)
+
+	rel, err := client.Run(chrt, values)
+	if err != nil {
+		t.Fatalf("Failed to render chart. chart=%v error=%v\n", chart, err)
+	}
+	return rel.Info.Notes
+}
+
+func checkNotes(t *testing.T, name string, notes string, expected []string, unexpected []string) {
+	for _, line := range expected {
+		if !strings.Contains(notes, line) {
+			t.Errorf("%s: notes are missing %q\n%s", name, line, notes)
+		}
+	}
+	for _, line := range unexpected {
+		if strings.Contains(notes, line) {
+			t.Errorf("%s: notes should not have %q\n%s", name, line, notes)
+		}
+	}
+}
+
+func TestCoreNotes(t *testing.T) {
+	const (
+		defaultPassword = "The admin account has the default password admin"
+		insecureUpdater = "Set cve.updater.secure to true."
+		bootstrap       = "kubectl get secret --namespace neuvector neuvector-bootstrap-secret"
+	)
+
+	cases := []struct {
+		name        string
+		values      map[string]string
+		apiVersions []string
+		expected    []string
+		unexpected  []string
+	}{
+		{
+			name: "default",
+			expected: []string{
+				"is installed in the neuvector namespace as release " + nvRel,
+				"  - controller, 3 replicas\n",
+				"  - enforcer, on every node\n",
+				"  - manager\n",
+				"  - scanner, 3 replicas\n",
+				`  - scanner updater, schedule "0 0 * * *"`,
+				"kubectl port-forward --namespace neuvector svc/neuvector-service-webui 8443:8443",
+				"browse to https://localhost:8443",
+				defaultPassword,
+				insecureUpdater,
+			},
+			unexpected: []string{"registry adapter", "Federation endpoints", bootstrap, "deprecated"},
+		},
+		{
+			name:     "manager without ssl",
+			values:   map[string]string{"manager.env.ssl": "false"},
+			expected: []string{"browse to http://localhost:8443"},
+		},
+		{
+			name:     "node port",
+			values:   map[string]string{"manager.svc.type": "NodePort"},
+			expected: []string{`NODE_PORT=$(kubectl get --namespace neuvector -o jsonpath="{.spec.ports[0].nodePort}" services neuvector-service-webui)`, "echo https://$NODE_IP:$NODE_PORT"},
+		},
+		{
+			name:     "fixed node port",
+			values:   map[string]string{"manager.svc.type": "NodePort", "manager.svc.nodePort": "30443"},
+			expected: []string{"NODE_PORT=30443", "echo https://$NODE_IP:$NODE_PORT"},
+		},
+		{
+			name:     "load balancer",
+			values:   map[string]string{"manager.svc.type": "LoadBalancer"},
+			expected: []string{`SERVICE_IP=$(kubectl get svc --namespace neuvector neuvector-service-webui -o jsonpath="{.status.loadBalancer.ingress[0].ip}")`, "echo https://$SERVICE_IP:8443"},
+		},
+		{
+			name:     "load balancer IP",
+			values:   map[string]string{"manager.svc.type": "LoadBalancer", "manager.svc.loadBalancerIP": "10.1.2.3"},
+			expected: []string{"https://10.1.2.3:8443"},
+		},
+		{
+			name:       "ingress",
+			values:     map[string]string{"manager.ingress.enabled": "true", "manager.ingress.host": "nv.example.com"},
+			expected:   []string{"The manager is exposed by the ingress neuvector-webui-ingress:\n  http://nv.example.com/"},
+			unexpected: []string{"port-forward"},
+		},
+		{
+			name:     "ingress with tls",
+			values:   map[string]string{"manager.ingress.enabled": "true", "manager.ingress.host": "nv.example.com", "manager.ingress.tls": "true", "manager.ingress.path": "/nv"},
+			expected: []string{"  https://nv.example.com/nv"},
+		},
+		{
+			name:        "route",
+			values:      map[string]string{"openshift": "true"},
+			apiVersions: []string{"route.openshift.io/v1"},
+			expected:    []string{"The manager is exposed by the route neuvector-route-webui:", `echo https://$(kubectl get route --namespace neuvector neuvector-route-webui -o jsonpath="{.spec.host}")`},
+		},
+		{
+			name:        "route with host",
+			values:      map[string]string{"openshift": "true", "manager.route.host": "nv.apps.example.com"},
+			apiVersions: []string{"route.openshift.io/v1"},
+			expected:    []string{"  https://nv.apps.example.com"},
+		},
+		{
+			name:     "route without the route API",
+			values:   map[string]string{"openshift": "true"},
+			expected: []string{"kubectl port-forward"},
+		},
+		{
+			name:       "manager disabled",
+			values:     map[string]string{"manager.enabled": "false"},
+			unexpected: []string{"  - manager\n", "port-forward", defaultPassword},
+		},
+		{
+			name:       "bootstrap password",
+			values:     map[string]string{"bootstrapPassword.value": "secret-password"},
+			expected:   []string{bootstrap},
+			unexpected: []string{defaultPassword, "randomly generated", "deprecated"},
+		},
+		{
+			name:       "bootstrap password from a secret",
+			values:     map[string]string{"bootstrapPassword.existingSecret": "neuvector-bootstrap-secret"},
+			expected:   []string{bootstrap},
+			unexpected: []string{defaultPassword, "randomly generated"},
+		},
+		{
+			name:       "bootstrap password from another secret",
+			values:     map[string]string{"bootstrapPassword.existingSecret": "admin-password", "bootstrapPassword.key": "password"},
+			expected:   []string{`kubectl get secret --namespace neuvector admin-password -o go-template='{{index .data "password"|base64decode}}`},
+			unexpected: []string{defaultPassword, "randomly generated", bootstrap},
+		},
+		{
+			name:       "generated bootstrap password",
+			values:     map[string]string{"bootstrapPassword.generate": "true"},
+			expected:   []string{bootstrap, "The password is randomly generated at install and kept on upgrades."},
+			unexpected: []string{defaultPassword, "AWS"},
+		},
+		{
+			name:       "aws billing",
+			values:     map[string]string{"global.aws.enabled": "true"},
+			expected:   []string{bootstrap, "The password is randomly generated at install and kept on upgrades, because AWS billing is enabled.", "  - CSP billing adapter"},
+			unexpected: []string{defaultPassword},
+		},
+		{
+			name: "admin password in userinitcfg",
+			values: map[string]string{
+				"controller.secret.enabled":                                   "true",
+				"controller.secret.data.userinitcfg\\.yaml.users[0].Fullname": "admin",
+				"controller.secret.data.userinitcfg\\.yaml.users[0].Password": "Admin-Password1",
+				"controller.secret.data.userinitcfg\\.yaml.users[0].Role":     "admin",
+			},
+			unexpected: []string{defaultPassword},
+		},
+		{
+			name: "admin password in initcfg",
+			values: map[string]string{
+				"controller.initcfg.user.users[0].Fullname": "admin",
+				"controller.initcfg.user.users[0].Password": "Admin-Password1",
+			},
+			unexpected: []string{defaultPassword},
+		},
+		{
+			name:       "secure updater",
+			values:     map[string]string{"cve.updater.secure": "true"},
+			unexpected: []string{insecureUpdater},
+		},
+		{
+			name:       "updater disabled",
+			values:     map[string]string{"cve.updater.enabled": "false"},
+			unexpected: []string{insecureUpdater, "scanner updater"},
+		},
+		{
+			name: "components",
+			values: map[string]string{
+				"controller.replicas":  "1",
+				"enforcer.enabled":     "false",
+				"cve.scanner.replicas": "2",
+				"cve.adapter.enabled":  "true",
+				"cve.updater.schedule": "0 6 * * *",
+			},
+			expected:   []string{"  - controller, 1 replicas\n", "  - scanner, 2 replicas\n", "  - registry adapter\n", `schedule "0 6 * * *"`},
+			unexpected: []string{"enforcer"},
+		},
+		{
+			name: "federation",
+			values: map[string]string{
+				"controller.federation.mastersvc.type":            "LoadBalancer",
+				"controller.federation.mastersvc.ingress.enabled": "true",
+				"controller.federation.mastersvc.ingress.host":    "fed.example.com",
+				"controller.federation.mastersvc.ingress.tls":     "true",
+				"controller.federation.managedsvc.type":           "NodePort",
+				"controller.federation.managedsvc.route.enabled":  "true",
+				"controller.federation.managedsvc.route.host":     "managed.apps.example.com",
+				"openshift": "true",
+				"controller.federation.managedsvc.ingress.enabled": "false",
+			},
+			apiVersions: []string{"route.openshift.io/v1"},
+			expected: []string{
+				"Federation endpoints:",
+				"  - primary cluster: service neuvector-svc-controller-fed-master (LoadBalancer), port 11443\n    ingress: https://fed.example.com/",
+				"  - managed cluster: service neuvector-svc-controller-fed-managed (NodePort), port 10443\n    route: neuvector-route-fed-managed, https://managed.apps.example.com",
+			},
+		},
+		{
+			name: "federation master role",
+			values: map[string]string{
+				"controller.federation.role":           "master",
+				"controller.federation.clusterName":    "cluster1",
+				"controller.federation.master.address": "10.1.1.1",
+			},
+			expected: []string{
+				"  The controller promotes this cluster to the primary cluster cluster1 with fedinitcfg.yaml in the secret neuvector-init.",
+				"  - primary cluster: service neuvector-svc-controller-fed-master (ClusterIP), port 11443",
+			},
+			unexpected: []string{"managed cluster"},
+		},
+		{
+			name:     "fullname override",
+			values:   map[string]string{"fullnameOverride": "acme", "controller.federation.mastersvc.type": "ClusterIP"},
+			expected: []string{"svc/acme-service-webui", "service acme-svc-controller-fed-master"},
+		},
+		{
+			name:       "deprecated values",
+			values:     map[string]string{"k3s.enabled": "true", "imagePullSecrets": "regcred", "bootstrapPassword": "secret-password"},
+			expected:   []string{"  - k3s.enabled:", "  - imagePullSecrets: a single string is deprecated", "  - bootstrapPassword: a string is deprecated", "go run ./cmd/migrate-values"},
+			unexpected: []string{"docker.path"},
+		},
+		{
+			name:       "runtime keys before 5.3",
+			values:     map[string]string{"tag": "5.2.4", "containerd.enabled": "true"},
+			unexpected: []string{"containerd.enabled", "deprecated"},
+		},
+	}
+
+	for _, c := range cases {
+		checkNotes(t, c.name, renderNotes(t, "core", c.values, c.apiVersions...), c.expected, c.unexpected)
+	}
+}
+
+func TestMonitorNotes(t *testing.T) {
+	const adminLogin = "The exporter logs in to the controller with the default admin/admin account."
+
+	cases := []struct {
+		name       string
+		values     map[string]string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name: "default",
+			expected: []string{
+				"It reads the metrics from the controller REST API at neuvector-svc-controller-api:10443.",
+				"The metrics are served by the service neuvector-prometheus-exporter (ClusterIP) on port 8068.",
+				adminLogin,
+			},
+			unexpected: []string{"ServiceMonitor", "Grafana", "deprecated"},
+		},
+		{
+			name:       "read-only user",
+			values:     map[string]string{"exporter.CTRL_USERNAME": "metrics", "exporter.CTRL_PASSWORD": "Metrics-Password1"},
+			unexpected: []string{adminLogin},
+		},
+		{
+			name:       "login secret",
+			values:     map[string]string{"exporter.ctrlSecretName": "exporter-login"},
+			unexpected: []string{adminLogin},
+		},
+		{
+			name:     "service monitor and dashboard",
+			values:   map[string]string{"exporter.serviceMonitor.enabled": "true", "exporter.grafanaDashboard.enabled": "true", "exporter.grafanaDashboard.namespace": "monitoring"},
+			expected: []string{"ServiceMonitor neuvector-prometheus-exporter", "ConfigMap nv-grafana-dashboard in the monitoring namespace"},
+		},
+		{
+			name:       "exporter disabled",
+			values:     map[string]string{"exporter.enabled": "false"},
+			expected:   []string{"The NeuVector Prometheus exporter is disabled."},
+			unexpected: []string{adminLogin},
+		},
+		{
+			name:     "deprecated values",
+			values:   map[string]string{"exporter.ctrlSercretName": "exporter-login", "imagePullSecrets": "regcred"},
+			expected: []string{"  - exporter.ctrlSercretName: the misspelled key is ignored", "  - imagePullSecrets: a single string is deprecated"},
+		},
+	}
+
+	for _, c := range cases {
+		checkNotes(t, c.name, renderNotes(t, "monitor", c.values), c.expected, c.unexpected)
+	}
+}
@@ -0,0 +1,335 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Kubernetes versions with a schema in schemas/kubernetes. Regenerate the schemas with:
+// go run schemas/update.go
+var openAPIKubeVersions = []string{"1.24", "1.25", "1.26", "1.27", "1.28", "1.29", "1.30", "1.31", "1.32", "1.33"}
+
+const quantityRef = "io.k8s.apimachinery.pkg.api.resource.Quantity"
+
+type openAPISchema struct {
+	Ref                   string                    `json:"$ref"`
+	Type                  string                    `json:"type"`
+	Format                string                    `json:"format"`
+	Properties            map[string]*openAPISchema `json:"properties"`
+	AdditionalProperties  json.RawMessage           `json:"additionalProperties"`
+	Items                 *openAPISchema            `json:"items"`
+	Required              []string                  `json:"required"`
+	Enum                  []interface{}             `json:"enum"`
+	AllOf                 []*openAPISchema          `json:"allOf"`
+	IntOrString           bool                      `json:"x-kubernetes-int-or-string"`
+	PreserveUnknownFields bool                      `json:"x-kubernetes-preserve-unknown-fields"`
+	GroupVersionKind      []struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"x-kubernetes-group-version-kind"`
+}
+
+// openAPIValidator validates objects against the Kubernetes OpenAPI v2 definitions of a
+// version and the OpenAPI v3 schemas of the custom resources the charts create.
+type openAPIValidator struct {
+	definitions map[string]*openAPISchema
+	kinds       map[string]*openAPISchema
+}
+
+var (
+	openAPIValidators = make(map[string]*openAPIValidator)
+	openAPILock       sync.Mutex
+)
+
+func gvkKey(apiVersion string, kind string) string {
+	return apiVersion + "/" + kind
+}
+
+func loadOpenAPIValidator(t *testing.T, version string) *openAPIValidator {
+	openAPILock.Lock()
+	defer openAPILock.Unlock()
+
+	if v, ok := openAPIValidators[version]; ok {
+		return v
+	}
+
+	data, err := os.ReadFile(filepath.Join("schemas", "kubernetes", "v"+version+".json"))
+	if err != nil {
+		t.Fatalf("Failed to read the Kubernetes schema. version=%v error=%v\n", version, err)
+	}
+	var spec struct {
+		Definitions map[string]*openAPISchema `json:"definitions"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("Failed to parse the Kubernetes schema. version=%v error=%v\n", version, err)
+	}
+
+	v := &openAPIValidator{definitions: spec.Definitions, kinds: make(map[string]*openAPISchema)}
+	for _, def := range spec.Definitions {
+		for _, gvk := range def.GroupVersionKind {
+			apiVersion := gvk.Version
+			if gvk.Group != "" {
+				apiVersion = gvk.Group + "/" + gvk.Version
+			}
+			v.kinds[gvkKey(apiVersion, gvk.Kind)] = def
+		}
+	}
+
+	// custom resources, schemas/crds/<group>_<version>_<kind>.json
+	crds, _ := filepath.Glob(filepath.Join("schemas", "crds", "*.json"))
+	for _, path := range crds {
+		parts := strings.Split(strings.TrimSuffix(filepath.Base(path), ".json"), "_")
+		if len(parts) != 3 {
+			t.Fatalf("Unexpected CRD schema file name. file=%v\n", path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read the CRD schema. file=%v error=%v\n", path, err)
+		}
+		var schema openAPISchema
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatalf("Failed to parse the CRD schema. file=%v error=%v\n", path, err)
+		}
+		v.kinds[gvkKey(parts[0]+"/"+parts[1], parts[2])] = &schema
+	}
+
+	openAPIValidators[version] = v
+	return v
+}
+
+// validateObject returns the schema violations of a rendered object.
+func (v *openAPIValidator) validateObject(obj map[string]interface{}) []string {
+	apiVersion, _ := obj["apiVersion"].(string)
+	kind, _ := obj["kind"].(string)
+	schema, ok := v.kinds[gvkKey(apiVersion, kind)]
+	if !ok {
+		return []string{fmt.Sprintf("%s %s is not served", apiVersion, kind)}
+	}
+
+	var errs []string
+	v.validate(kind, obj, schema, &errs)
+	return errs
+}
+
+func (v *openAPIValidator) validate(path string, value interface{}, schema *openAPISchema, errs *[]string) {
+	if value == nil || schema == nil {
+		return
+	}
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/definitions/")
+		if name == quantityRef {
+			switch value.(type) {
+			case string, float64:
+			default:
+				*errs = append(*errs, fmt.Sprintf("%s: quantity must be a string or a number", path))
+			}
+			return
+		}
+		def, ok := v.definitions[name]
+		if !ok {
+			*errs = append(*errs, fmt.Sprintf("%s: unknown definition %s", path, name))
+			return
+		}
+		v.validate(path, value, def, errs)
+		return
+	}
+	for _, sub := range schema.AllOf {
+		v.validate(path, value, sub, errs)
+	}
+
+	if schema.IntOrString || schema.Format == "int-or-string" {
+		if _, ok := value.(string); !ok && !isInteger(value) {
+			*errs = append(*errs, fmt.Sprintf("%s: must be an integer or a string", path))
+		}
+		return
+	}
+
+	if len(schema.Enum) > 0 && !inEnum(value, schema.Enum) {
+		*errs = append(*errs, fmt.Sprintf("%s: %v is not one of %v", path, value, schema.Enum))
+	}
+
+	switch schema.Type {
+	case "object":
+		v.validateFields(path, value, schema, errs)
+	case "":
+		if schema.Properties != nil {
+			v.validateFields(path, value, schema, errs)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			*errs = append(*errs, fmt.Sprintf("%s: must be an array", path))
+			return
+		}
+		for i, item := range items {
+			v.validate(fmt.Sprintf("%s[%d]", path, i), item, schema.Items, errs)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			*errs = append(*errs, fmt.Sprintf("%s: must be a string", path))
+		}
+	case "integer":
+		if !isInteger(value) {
+			*errs = append(*errs, fmt.Sprintf("%s: must be an integer", path))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			*errs = append(*errs, fmt.Sprintf("%s: must be a number", path))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			*errs = append(*errs, fmt.Sprintf("%s: must be a boolean", path))
+		}
+	}
+}
+
+func (v *openAPIValidator) validateFields(path string, value interface{}, schema *openAPISchema, errs *[]string) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		*errs = append(*errs, fmt.Sprintf("%s: must be an object", path))
+		return
+	}
+
+	var additional *openAPISchema
+	allowUnknown := schema.PreserveUnknownFields || schema.Properties == nil
+	if len(schema.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(schema.AdditionalProperties, &allowed); err == nil {
+			allowUnknown = allowed
+		} else {
+			additional = &openAPISchema{}
+			_ = json.Unmarshal(schema.AdditionalProperties, additional)
+		}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if prop, ok := schema.Properties[k]; ok {
+			v.validate(path+"."+k, fields[k], prop, errs)
+		} else if additional != nil {
+			v.validate(path+"."+k, fields[k], additional, errs)
+		} else if !allowUnknown {
+			*errs = append(*errs, fmt.Sprintf("%s: unknown field %q", path, k))
+		}
+	}
+	for _, k := range schema.Required {
+		if _, ok := fields[k]; !ok {
+			*errs = append(*errs, fmt.Sprintf("%s: missing required field %q", path, k))
+		}
+	}
+}
+
+func isInteger(value interface{}) bool {
+	f, ok := value.(float64)
+	return ok && f == math.Trunc(f)
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateManifests validates every object of the rendered output.
+func validateManifests(t *testing.T, v *openAPIValidator, out string) {
+	for _, output := range splitYaml(out) {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(output), &obj); err != nil {
+			t.Errorf("Failed to parse the rendered object. error=%v\n", err)
+			continue
+		}
+		for _, err := range v.validateObject(obj) {
+			meta, _ := obj["metadata"].(map[string]interface{})
+			t.Errorf("%v/%v: %v\n", obj["kind"], meta["name"], err)
+		}
+	}
+}
+
+func TestOpenAPIValidation(t *testing.T) {
+	fixtures := loadFixtures(t)
+	for _, version := range openAPIKubeVersions {
+		v := loadOpenAPIValidator(t, version)
+		for name, fixture := range fixtures {
+			for _, chart := range snapshotCharts {
+				t.Run(fmt.Sprintf("%s/%s/%s", version, name, chart), func(t *testing.T) {
+					t.Parallel()
+					validateManifests(t, v, renderFixture(t, fixture, chart, version+".0"))
+				})
+			}
+		}
+	}
+}
+
+func TestOpenAPIValidatorRejectsInvalidObjects(t *testing.T) {
+	v := loadOpenAPIValidator(t, "1.33")
+
+	cases := map[string]string{
+		"unknown field": `
+apiVersion: v1
+kind: Service
+metadata:
+  name: test
+spec:
+  prots:
+    - port: 443`,
+		"mistyped field": `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test
+spec:
+  replicas: "3"
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      containers:
+        - name: test
+          image: test`,
+		"not served": `
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: test`,
+		"custom resource": `
+apiVersion: route.openshift.io/v1
+kind: Route
+metadata:
+  name: test
+spec:
+  to:
+    kind: Service
+    name: test
+  tls:
+    termination: passthrough
+    insecure: true`,
+	}
+
+	for name, manifest := range cases {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(manifest), &obj); err != nil {
+			t.Fatalf("Failed to parse the test object. case=%v error=%v\n", name, err)
+		}
+		if errs := v.validateObject(obj); len(errs) == 0 {
+			t.Errorf("Invalid object is accepted. case=%v\n", name)
+		}
+	}
+}
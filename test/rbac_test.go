@@ -0,0 +1,394 @@
+package test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"sigs.k8s.io/yaml"
+)
+
+type rbacRule struct {
+	APIGroups       []string `json:"apiGroups"`
+	Resources       []string `json:"resources"`
+	ResourceNames   []string `json:"resourceNames"`
+	Verbs           []string `json:"verbs"`
+	NonResourceURLs []string `json:"nonResourceURLs"`
+}
+
+// rbacObject is a Role, ClusterRole or binding of either rbac.authorization.k8s.io or
+// authorization.openshift.io. OpenShift bindings may omit roleRef.kind and list the
+// service accounts in userNames as well as in subjects.
+type rbacObject struct {
+	namedObject `json:",inline"`
+	Rules       []rbacRule `json:"rules"`
+	RoleRef     struct {
+		Kind      string `json:"kind"`
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"roleRef"`
+	Subjects []struct {
+		Kind      string `json:"kind"`
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"subjects"`
+	UserNames []string `json:"userNames"`
+}
+
+// Built-in cluster roles the chart binds, with the rules they grant at most. The Kubernetes
+// admin and view roles grant less, e.g. view cannot read secrets, so a comparison that passes
+// with them is only as strict as the chart's own roles.
+var rbacBuiltinRoles = map[string][]rbacRule{
+	"cluster-admin": {{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}},
+	"admin":         {{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}},
+	"edit":          {{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"create", "delete", "deletecollection", "get", "list", "patch", "update", "watch"}}},
+	"view":          {{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"get", "list", "watch"}}},
+	"system:openshift:scc:privileged": {{
+		APIGroups: []string{"security.openshift.io"}, Resources: []string{"securitycontextconstraints"},
+		ResourceNames: []string{"privileged"}, Verbs: []string{"use"},
+	}},
+}
+
+// rbacGrant is a rule granted to a service account by a binding. Namespace is empty for
+// cluster-wide grants.
+type rbacGrant struct {
+	namespace string
+	binding   string
+	role      string
+	builtin   bool
+	rule      rbacRule
+}
+
+// rbacPermission is a single verb on a resource.
+type rbacPermission struct {
+	namespace    string
+	apiGroup     string
+	resource     string
+	resourceName string
+	verb         string
+}
+
+func rbacMatch(pattern string, value string) bool {
+	return pattern == "*" || pattern == value
+}
+
+// covers reports if p grants everything q grants. Cluster-wide permissions cover every
+// namespace and a permission without a resource name covers every name.
+func (p rbacPermission) covers(q rbacPermission) bool {
+	if p.namespace != "" && p.namespace != q.namespace {
+		return false
+	}
+	if p.resourceName != "" && p.resourceName != q.resourceName {
+		return false
+	}
+	return rbacMatch(p.apiGroup, q.apiGroup) && rbacMatch(p.resource, q.resource) && rbacMatch(p.verb, q.verb)
+}
+
+func (p rbacPermission) String() string {
+	scope := "cluster"
+	if p.namespace != "" {
+		scope = "namespace " + p.namespace
+	}
+	resource := p.resource
+	if p.apiGroup != "" {
+		resource += "." + p.apiGroup
+	}
+	if p.resourceName != "" {
+		resource += "/" + p.resourceName
+	}
+	return fmt.Sprintf("%s %s in %s", p.verb, resource, scope)
+}
+
+func (g *rbacGrant) permissions() []rbacPermission {
+	var perms []rbacPermission
+	names := g.rule.ResourceNames
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	for _, group := range g.rule.APIGroups {
+		for _, resource := range g.rule.Resources {
+			for _, name := range names {
+				for _, verb := range g.rule.Verbs {
+					perms = append(perms, rbacPermission{g.namespace, group, resource, name, verb})
+				}
+			}
+		}
+	}
+	for _, url := range g.rule.NonResourceURLs {
+		for _, verb := range g.rule.Verbs {
+			perms = append(perms, rbacPermission{resource: url, verb: verb})
+		}
+	}
+	return perms
+}
+
+// rbacMatrix holds the effective grants of each service account, keyed by "namespace:name".
+type rbacMatrix map[string][]rbacGrant
+
+// buildRBACMatrix resolves the rendered bindings to the rules of their roles.
+func buildRBACMatrix(t *testing.T, out string, namespace string) rbacMatrix {
+	roles := make(map[string]*rbacObject)
+	var bindings []*rbacObject
+	for _, output := range splitYaml(out) {
+		var obj rbacObject
+		if err := yaml.Unmarshal([]byte(output), &obj); err != nil {
+			t.Fatalf("Failed to parse the rendered object. error=%v\n", err)
+		}
+		if obj.Namespace == "" {
+			obj.Namespace = namespace
+		}
+		switch obj.Kind {
+		case "ClusterRole":
+			roles["ClusterRole/"+obj.Name] = &obj
+		case "Role":
+			roles["Role/"+obj.Namespace+"/"+obj.Name] = &obj
+		case "ClusterRoleBinding", "RoleBinding":
+			bindings = append(bindings, &obj)
+		}
+	}
+
+	matrix := make(rbacMatrix)
+	for _, b := range bindings {
+		grantNS := b.Namespace
+		if b.Kind == "ClusterRoleBinding" {
+			grantNS = ""
+		}
+
+		// OpenShift bindings without roleRef.kind: a role binding refers to the role of its
+		// namespace if there is one, anything else to a cluster role.
+		kind := b.RoleRef.Kind
+		if kind == "" {
+			kind = "ClusterRole"
+			if _, ok := roles["Role/"+b.Namespace+"/"+b.RoleRef.Name]; ok && b.Kind == "RoleBinding" {
+				kind = "Role"
+			}
+		}
+
+		var rules []rbacRule
+		builtin := false
+		role := kind + "/" + b.RoleRef.Name
+		if r, ok := roles[kind+"/"+b.RoleRef.Name]; ok && kind == "ClusterRole" {
+			rules = r.Rules
+		} else if r, ok := roles["Role/"+b.Namespace+"/"+b.RoleRef.Name]; ok && kind == "Role" {
+			rules = r.Rules
+		} else if r, ok := rbacBuiltinRoles[b.RoleRef.Name]; ok && kind == "ClusterRole" {
+			rules, builtin = r, true
+		} else {
+			t.Errorf("%s/%s refers to %s which is not rendered\n", b.Kind, b.Name, role)
+			continue
+		}
+
+		accounts := make(map[string]bool)
+		for _, s := range b.Subjects {
+			if s.Kind == "ServiceAccount" {
+				ns := s.Namespace
+				if ns == "" {
+					ns = b.Namespace
+				}
+				accounts[ns+":"+s.Name] = true
+			}
+		}
+		for _, user := range b.UserNames {
+			if sa := strings.TrimPrefix(user, "system:serviceaccount:"); sa != user {
+				accounts[sa] = true
+			}
+		}
+
+		for sa := range accounts {
+			for _, rule := range rules {
+				matrix[sa] = append(matrix[sa], rbacGrant{
+					namespace: grantNS,
+					binding:   b.Kind + "/" + b.Name,
+					role:      role,
+					builtin:   builtin,
+					rule:      rule,
+				})
+			}
+		}
+	}
+	return matrix
+}
+
+// missingPermissions returns the permissions granted to any service account of m that no
+// service account of base grants.
+func (m rbacMatrix) missingPermissions(base rbacMatrix) []string {
+	var granted []rbacPermission
+	for _, grants := range base {
+		for i := range grants {
+			granted = append(granted, grants[i].permissions()...)
+		}
+	}
+
+	var missing []string
+	for sa, grants := range m {
+		for i := range grants {
+			for _, p := range grants[i].permissions() {
+				covered := false
+				for _, g := range granted {
+					if g.covers(p) {
+						covered = true
+						break
+					}
+				}
+				if !covered {
+					missing = append(missing, fmt.Sprintf("%s: %s by %s", sa, p.String(), grants[i].binding))
+				}
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// rbacMode is a way to install the chart whose permissions are compared.
+type rbacMode struct {
+	name   string
+	values map[string]string
+	args   []string
+}
+
+func (mode *rbacMode) render(t *testing.T, leastPrivilege bool) rbacMatrix {
+	values := map[string]string{"leastPrivilege": fmt.Sprint(leastPrivilege)}
+	for k, v := range mode.values {
+		values[k] = v
+	}
+	options := &helm.Options{
+		SetValues: values,
+		Logger:    logger.Discard,
+	}
+	out := helm.RenderTemplate(t, options, "../charts/core", nvRel, []string{}, mode.args...)
+	return buildRBACMatrix(t, out, "default")
+}
+
+var rbacModes = []rbacMode{
+	{name: "Kubernetes"},
+	{
+		name:   "OpenShift",
+		values: map[string]string{"openshift": "true"},
+		args:   []string{"--api-versions", "security.openshift.io/v1"},
+	},
+	{
+		name:   "OpenShift 3.x",
+		values: map[string]string{"openshift": "true"},
+		args:   []string{"--kube-version", "1.11.0"},
+	},
+}
+
+func TestRBACLeastPrivilegeSubset(t *testing.T) {
+	for _, mode := range rbacModes {
+		def := mode.render(t, false)
+		least := mode.render(t, true)
+
+		if len(def) == 0 || len(least) == 0 {
+			t.Errorf("%s: no service account is granted anything\n", mode.name)
+		}
+		if _, ok := def["default:default"]; !ok || len(def) != 1 {
+			t.Errorf("%s: default mode should only grant the default service account\n", mode.name)
+		}
+		if _, ok := least["default:controller"]; !ok {
+			t.Errorf("%s: leastPrivilege mode does not grant the controller service account\n", mode.name)
+		}
+		for _, p := range least.missingPermissions(def) {
+			t.Errorf("%s: leastPrivilege grants more than default mode: %s\n", mode.name, p)
+		}
+	}
+}
+
+func TestRBACMatrix(t *testing.T) {
+	out := `
+apiVersion: authorization.openshift.io/v1
+kind: ClusterRole
+metadata:
+  name: test-app
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["get", "list"]
+---
+apiVersion: authorization.openshift.io/v1
+kind: Role
+metadata:
+  name: test-secret
+  namespace: neuvector
+rules:
+- apiGroups: [""]
+  resources: ["secrets"]
+  resourceNames: ["test"]
+  verbs: ["get"]
+---
+apiVersion: authorization.openshift.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: test-app
+roleRef:
+  name: test-app
+subjects:
+- kind: ServiceAccount
+  name: controller
+  namespace: neuvector
+userNames:
+- system:serviceaccount:neuvector:enforcer
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: test-secret
+  namespace: neuvector
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: test-secret
+subjects:
+- kind: ServiceAccount
+  name: controller
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: test-view
+  namespace: neuvector
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: view
+subjects:
+- kind: ServiceAccount
+  name: scanner
+  namespace: neuvector`
+
+	m := buildRBACMatrix(t, out, "neuvector")
+	if len(m) != 3 || len(m["neuvector:controller"]) != 2 || len(m["neuvector:enforcer"]) != 1 {
+		t.Fatalf("Unexpected grants. matrix=%+v\n", m)
+	}
+
+	cases := []struct {
+		sa      string
+		perm    rbacPermission
+		granted bool
+	}{
+		{"neuvector:controller", rbacPermission{"", "", "pods", "", "list"}, true},
+		{"neuvector:controller", rbacPermission{"other", "", "pods", "", "get"}, true},
+		{"neuvector:controller", rbacPermission{"neuvector", "", "secrets", "test", "get"}, true},
+		{"neuvector:controller", rbacPermission{"neuvector", "", "secrets", "other", "get"}, false},
+		{"neuvector:controller", rbacPermission{"other", "", "secrets", "test", "get"}, false},
+		{"neuvector:enforcer", rbacPermission{"", "", "pods", "", "watch"}, false},
+		{"neuvector:scanner", rbacPermission{"neuvector", "apps", "deployments", "", "get"}, true},
+		{"neuvector:scanner", rbacPermission{"", "apps", "deployments", "", "get"}, false},
+	}
+	for _, c := range cases {
+		granted := false
+		for i := range m[c.sa] {
+			for _, p := range m[c.sa][i].permissions() {
+				if p.covers(c.perm) {
+					granted = true
+				}
+			}
+		}
+		if granted != c.granted {
+			t.Errorf("Unexpected permission. sa=%v permission=%v granted=%v\n", c.sa, c.perm.String(), granted)
+		}
+	}
+}
@@ -39,7 +39,7 @@ func TestRegistryAdapterIngress(t *testing.T) {
 	}
 
 	// Test ingress
-	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/registry-adapter-ingress.yaml"})
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/registry-adapter-ingress.yaml"}, "--api-versions", "route.openshift.io/v1")
 	outs := splitYaml(out)
 
 	if len(outs) != 2 {
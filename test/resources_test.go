@@ -0,0 +1,198 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podWorkload decodes the pod spec of a Deployment, DaemonSet or CronJob.
+type podWorkload struct {
+	Spec struct {
+		Template    corev1.PodTemplateSpec  `json:"template"`
+		JobTemplate batchv1.JobTemplateSpec `json:"jobTemplate"`
+	} `json:"spec"`
+}
+
+// workloadResources returns the resources of the containers and init containers of the
+// workloads, keyed by "Kind/name/container".
+func workloadResources(t *testing.T, objs map[string]string, workloads ...string) map[string]corev1.ResourceRequirements {
+	resources := make(map[string]corev1.ResourceRequirements)
+	for _, name := range workloads {
+		doc, ok := objs[name]
+		if !ok {
+			t.Fatalf("%s is not rendered\n", name)
+		}
+		var w podWorkload
+		helm.UnmarshalK8SYaml(t, doc, &w)
+		spec := w.Spec.Template.Spec
+		if len(spec.Containers) == 0 {
+			spec = w.Spec.JobTemplate.Spec.Template.Spec
+		}
+		for _, c := range append(spec.InitContainers, spec.Containers...) {
+			resources[name+"/"+c.Name] = c.Resources
+		}
+	}
+	return resources
+}
+
+// checkResources compares the cpu and memory requests and limits with "cpu/memory" strings.
+func checkResources(t *testing.T, name string, actual corev1.ResourceRequirements, requests string, limits string) {
+	format := func(list corev1.ResourceList) string {
+		if len(list) == 0 {
+			return ""
+		}
+		cpu := list[corev1.ResourceCPU]
+		memory := list[corev1.ResourceMemory]
+		return cpu.String() + "/" + memory.String()
+	}
+	if format(actual.Requests) != requests || format(actual.Limits) != limits {
+		t.Errorf("%s: resources are wrong. requests=%v limits=%v\n", name, format(actual.Requests), format(actual.Limits))
+	}
+}
+
+var coreWorkloads = []string{
+	"Deployment/neuvector-controller-pod",
+	"DaemonSet/neuvector-enforcer-pod",
+	"Deployment/neuvector-manager-pod",
+	"Deployment/neuvector-scanner-pod",
+	"Deployment/neuvector-registry-adapter-pod",
+	"CronJob/neuvector-updater-pod",
+	"CronJob/neuvector-cert-upgrader-pod",
+	"Deployment/neuvector-csp-pod",
+}
+
+// the components of the containers of coreWorkloads, the jobs share a preset
+var coreContainers = map[string]string{
+	"Deployment/neuvector-controller-pod/neuvector-controller-pod":             "controller",
+	"Deployment/neuvector-controller-pod/init":                                 "job",
+	"Deployment/neuvector-controller-pod/prime-config-container":               "job",
+	"DaemonSet/neuvector-enforcer-pod/neuvector-enforcer-pod":                  "enforcer",
+	"Deployment/neuvector-manager-pod/neuvector-manager-pod":                   "manager",
+	"Deployment/neuvector-scanner-pod/neuvector-scanner-pod":                   "scanner",
+	"Deployment/neuvector-registry-adapter-pod/neuvector-registry-adapter-pod": "adapter",
+	"CronJob/neuvector-updater-pod/neuvector-updater-pod":                      "job",
+	"CronJob/neuvector-cert-upgrader-pod/neuvector-cert-upgrader-pod":          "job",
+	"Deployment/neuvector-csp-pod/neuvector-csp-pod":                           "job",
+}
+
+// requests and limits of each preset and component, as cpu/memory
+var resourcesPresets = map[string]map[string][2]string{
+	"small": {
+		"controller": {"100m/1Gi", "500m/2Gi"},
+		"enforcer":   {"100m/512Mi", "500m/1Gi"},
+		"manager":    {"50m/256Mi", "250m/512Mi"},
+		"scanner":    {"100m/1Gi", "1/2Gi"},
+		"adapter":    {"50m/128Mi", "250m/256Mi"},
+		"job":        {"50m/64Mi", "100m/128Mi"},
+	},
+	"medium": {
+		"controller": {"250m/2Gi", "1/3Gi"},
+		"enforcer":   {"200m/1Gi", "1/2Gi"},
+		"manager":    {"100m/512Mi", "500m/1Gi"},
+		"scanner":    {"250m/2Gi", "2/3Gi"},
+		"adapter":    {"100m/256Mi", "500m/512Mi"},
+		"job":        {"50m/128Mi", "200m/256Mi"},
+	},
+	"large": {
+		"controller": {"500m/3Gi", "2/4Gi"},
+		"enforcer":   {"400m/2Gi", "2/3Gi"},
+		"manager":    {"200m/1Gi", "1/2Gi"},
+		"scanner":    {"500m/3Gi", "4/4Gi"},
+		"adapter":    {"200m/512Mi", "1/1Gi"},
+		"job":        {"100m/128Mi", "200m/256Mi"},
+	},
+	"xlarge": {
+		"controller": {"1/4Gi", "4/8Gi"},
+		"enforcer":   {"800m/3Gi", "4/6Gi"},
+		"manager":    {"400m/2Gi", "2/4Gi"},
+		"scanner":    {"1/4Gi", "8/8Gi"},
+		"adapter":    {"400m/1Gi", "2/2Gi"},
+		"job":        {"100m/256Mi", "500m/512Mi"},
+	},
+}
+
+func TestResourcesPreset(t *testing.T) {
+	for _, preset := range []string{"none", "small", "medium", "large", "xlarge"} {
+		options := &helm.Options{
+			SetValues: map[string]string{
+				"resourcesPreset":          preset,
+				"cve.adapter.enabled":      "true",
+				"controller.prime.enabled": "true",
+				"global.aws.enabled":       "true",
+			},
+			Logger: logger.Discard,
+		}
+		objs, _ := renderObjects(t, "../charts/core", options)
+		resources := workloadResources(t, objs, coreWorkloads...)
+		if len(resources) != len(coreContainers) {
+			t.Errorf("%s: unexpected containers. containers=%v\n", preset, resources)
+		}
+		for name, component := range coreContainers {
+			expected := resourcesPresets[preset][component]
+			checkResources(t, preset+": "+name, resources[name], expected[0], expected[1])
+		}
+
+		options = &helm.Options{
+			SetValues: map[string]string{"resourcesPreset": preset},
+			Logger:    logger.Discard,
+		}
+		objs, _ = renderObjects(t, "../charts/monitor", options)
+		resources = workloadResources(t, objs, "Deployment/neuvector-prometheus-exporter-pod")
+		expected := resourcesPresets[preset]["job"]
+		checkResources(t, preset+": exporter", resources["Deployment/neuvector-prometheus-exporter-pod/neuvector-prometheus-exporter-pod"], expected[0], expected[1])
+	}
+}
+
+func TestResourcesPrecedence(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"resourcesPreset":                                 "large",
+			"controller.resources.limits.cpu":                 "3",
+			"controller.resources.limits.memory":              "5Gi",
+			"controller.certupgrader.resources.limits.cpu":    "150m",
+			"controller.certupgrader.resources.limits.memory": "192Mi",
+			"resources.requests.cpu":                          "300m",
+			"resources.requests.memory":                       "1Gi",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+	resources := workloadResources(t, objs, coreWorkloads[:4]...)
+
+	// the resources of a component win over the top-level resources and the preset
+	checkResources(t, "controller", resources["Deployment/neuvector-controller-pod/neuvector-controller-pod"], "", "3/5Gi")
+	checkResources(t, "cert upgrader init", resources["Deployment/neuvector-controller-pod/init"], "", "150m/192Mi")
+	// the top-level resources win over the preset of the components that fall back to them
+	checkResources(t, "enforcer", resources["DaemonSet/neuvector-enforcer-pod/neuvector-enforcer-pod"], "300m/1Gi", "")
+	checkResources(t, "manager", resources["Deployment/neuvector-manager-pod/neuvector-manager-pod"], "300m/1Gi", "")
+	checkResources(t, "scanner", resources["Deployment/neuvector-scanner-pod/neuvector-scanner-pod"], "500m/3Gi", "4/4Gi")
+
+	options = &helm.Options{
+		SetValues: map[string]string{
+			"resourcesPreset":                  "xlarge",
+			"exporter.resources.limits.cpu":    "250m",
+			"exporter.resources.limits.memory": "300Mi",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ = renderObjects(t, "../charts/monitor", options)
+	resources = workloadResources(t, objs, "Deployment/neuvector-prometheus-exporter-pod")
+	checkResources(t, "exporter", resources["Deployment/neuvector-prometheus-exporter-pod/neuvector-prometheus-exporter-pod"], "", "250m/300Mi")
+}
+
+func TestResourcesPresetInvalid(t *testing.T) {
+	for _, chart := range []string{"core", "monitor"} {
+		options := &helm.Options{
+			SetValues: map[string]string{"resourcesPreset": "huge"},
+			Logger:    logger.Discard,
+		}
+		_, err := helm.RenderTemplateE(t, options, "../charts/"+chart, nvRel, []string{})
+		if err == nil {
+			t.Errorf("%s: resourcesPreset huge should be rejected\n", chart)
+		}
+	}
+}
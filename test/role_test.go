@@ -1,6 +1,7 @@
 package test
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/gruntwork-io/terratest/modules/helm"
@@ -102,3 +103,119 @@ func TestRoleBindingLeastPrivilege(t *testing.T) {
 		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
 	}
 }
+
+func TestRoleBindingOpenShiftAutoDetect(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/rolebinding.yaml"}, "--api-versions", "security.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 7 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	found := false
+	for _, output := range outs {
+		var rb rbacv1.RoleBinding
+		helm.UnmarshalK8SYaml(t, output, &rb)
+		if rb.Name == "system:openshift:scc:privileged" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Privileged SCC role binding is not rendered on OpenShift\n")
+	}
+}
+
+// TestRoleBindingOpenShift3UserNames checks that the userNames of the authorization.openshift.io
+// bindings on OpenShift 3 are the service accounts of their subjects.
+func TestRoleBindingOpenShift3UserNames(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"serviceAccount": "neuvector-sa",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/rolebinding.yaml"}, "--kube-version", "1.11.0", "--api-versions", "security.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 5 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	for _, output := range outs {
+		var rb struct {
+			rbacv1.RoleBinding `json:",inline"`
+			UserNames          []string `json:"userNames"`
+		}
+		helm.UnmarshalK8SYaml(t, output, &rb)
+		if rb.APIVersion != "authorization.openshift.io/v1" {
+			t.Errorf("Role binding is not an OpenShift 3 binding. name=%v apiVersion=%v\n", rb.Name, rb.APIVersion)
+		}
+
+		var expected []string
+		for _, s := range rb.Subjects {
+			expected = append(expected, "system:serviceaccount:"+s.Namespace+":"+s.Name)
+		}
+		if len(expected) == 0 || !reflect.DeepEqual(rb.UserNames, expected) {
+			t.Errorf("userNames do not match the subjects. name=%v userNames=%v subjects=%v\n", rb.Name, rb.UserNames, expected)
+		}
+	}
+}
+
+func TestClusterRoleOpenShiftAutoDetect(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	// Kubernetes
+	options := &helm.Options{
+		SetValues: map[string]string{},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/clusterrole.yaml"})
+	outs := splitYaml(out)
+
+	if len(outs) != 4 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	// OpenShift
+	out = helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/clusterrole.yaml"},
+		"--api-versions", "route.openshift.io/v1", "--api-versions", "security.openshift.io/v1")
+	outs = splitYaml(out)
+
+	if len(outs) != 5 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	for _, output := range outs {
+		var r rbacv1.ClusterRole
+		helm.UnmarshalK8SYaml(t, output, &r)
+		if r.Name == "neuvector-binding-rbac" && r.Rules[0].APIGroups[0] != "image.openshift.io" {
+			t.Errorf("Image stream rule is missing. rules=%+v\n", r.Rules)
+		}
+	}
+}
+
+func TestClusterRoleOpenShiftForcedOff(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"openshift": "false",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/clusterrole.yaml"},
+		"--api-versions", "route.openshift.io/v1", "--api-versions", "security.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 4 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+}
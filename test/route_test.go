@@ -1,12 +1,35 @@
 package test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 )
 
+// route holds the fields of an OpenShift Route checked by the tests.
+type route struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Host           string `json:"host"`
+		WildcardPolicy string `json:"wildcardPolicy"`
+		TLS            struct {
+			Termination              string `json:"termination"`
+			DestinationCACertificate string `json:"destinationCACertificate"`
+			ExternalCertificate      *struct {
+				Name string `json:"name"`
+			} `json:"externalCertificate"`
+		} `json:"tls"`
+	} `json:"spec"`
+}
+
 func TestManagerRouter(t *testing.T) {
 	helmChartPath := "../charts/core"
 
@@ -18,7 +41,7 @@ func TestManagerRouter(t *testing.T) {
 	}
 
 	// Test controller service
-	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"})
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
 	outs := splitYaml(out)
 
 	if len(outs) != 1 {
@@ -40,7 +63,27 @@ func TestControllerAPISVCRouter(t *testing.T) {
 	}
 
 	// Test controller service
-	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/controller-route.yaml"})
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/controller-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 1 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var svc corev1.Service
+	helm.UnmarshalK8SYaml(t, outs[0], &svc)
+}
+
+func TestManagerRouterAutoDetect(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"openshift": "auto",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
 	outs := splitYaml(out)
 
 	if len(outs) != 1 {
@@ -49,4 +92,302 @@ func TestControllerAPISVCRouter(t *testing.T) {
 
 	var svc corev1.Service
 	helm.UnmarshalK8SYaml(t, outs[0], &svc)
+	if svc.Kind != "Route" || svc.APIVersion != "route.openshift.io/v1" {
+		t.Errorf("Incorrect route. kind=%v apiVersion=%v\n", svc.Kind, svc.APIVersion)
+	}
+}
+
+func TestManagerRouterNoRouteAPI(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	for _, openshift := range []string{"auto", "true"} {
+		options := &helm.Options{
+			SetValues: map[string]string{
+				"openshift": openshift,
+			},
+		}
+
+		// Route API is not served by the cluster, so no route should be rendered
+		out, _ := helm.RenderTemplateE(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"})
+		outs := splitYaml(out)
+
+		if len(outs) != 0 {
+			t.Errorf("Resource count is wrong. openshift=%v count=%v\n", openshift, len(outs))
+		}
+	}
+}
+
+func TestManagerRouterOpenShiftDisabled(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"openshift": "false",
+		},
+	}
+
+	out, _ := helm.RenderTemplateE(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 0 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+}
+
+func TestManagerRouteReencrypt(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"manager.route.termination": "reencrypt",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/manager-secret.yaml", "templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 2 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var secret corev1.Secret
+	helm.UnmarshalK8SYaml(t, outs[0], &secret)
+	var r route
+	helm.UnmarshalK8SYaml(t, outs[1], &r)
+
+	// The destination CA must be the certificate generated for the manager in the same render
+	pem := secret.Data["ssl-cert.pem"]
+	if r.Spec.TLS.Termination != "reencrypt" {
+		t.Errorf("Incorrect termination. termination=%v\n", r.Spec.TLS.Termination)
+	}
+	if r.Spec.TLS.DestinationCACertificate == "" || strings.TrimSpace(r.Spec.TLS.DestinationCACertificate) != strings.TrimSpace(string(pem)) {
+		t.Errorf("Destination CA doesn't match the manager certificate. ca=%v\n", r.Spec.TLS.DestinationCACertificate)
+	}
+}
+
+func TestManagerRouteReencryptDestinationCA(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"manager.route.termination":                  "reencrypt",
+			"manager.route.tls.destinationCACertificate": "my-ca",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 1 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var r route
+	helm.UnmarshalK8SYaml(t, outs[0], &r)
+	if r.Spec.TLS.DestinationCACertificate != "my-ca" {
+		t.Errorf("Destination CA should come from values. ca=%v\n", r.Spec.TLS.DestinationCACertificate)
+	}
+}
+
+func TestManagerRouteReencryptCertificateSecret(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	// The CA of a certificate secret is not read from the cluster
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"manager.route.termination":  "reencrypt",
+			"manager.certificate.secret": "manager-tls",
+		},
+	}
+
+	_, err := helm.RenderTemplateE(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	if err == nil || !strings.Contains(err.Error(), "route.tls.destinationCACertificate") {
+		t.Errorf("Reencrypt route with a certificate secret should require the destination CA. err=%v\n", err)
+	}
+
+	options.SetValues["manager.route.tls.destinationCACertificate"] = "my-ca"
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 1 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var r route
+	helm.UnmarshalK8SYaml(t, outs[0], &r)
+	if r.Spec.TLS.DestinationCACertificate != "my-ca" {
+		t.Errorf("Destination CA should come from values. ca=%v\n", r.Spec.TLS.DestinationCACertificate)
+	}
+}
+
+func TestManagerRouteReencryptUnknownCA(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	// The CA of a certificate generated in the cluster or of the built-in certificate is not known
+	// when rendering, the route would not verify the backend
+	cases := map[string]map[string]string{
+		"gitops.enabled":        {"gitops.enabled": "true"},
+		"no certificate is set": {"autoGenerateCert": "false"},
+	}
+	for message, values := range cases {
+		options := &helm.Options{
+			SetValues: mergeValues(map[string]string{"manager.route.termination": "reencrypt"}, values),
+			Logger:    logger.Discard,
+		}
+		_, err := helm.RenderTemplateE(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+		if err == nil || !strings.Contains(err.Error(), "route.tls.destinationCACertificate") || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: reencrypt route should require the destination CA. err=%v\n", message, err)
+		}
+
+		options.SetValues["manager.route.tls.destinationCACertificate"] = "my-ca"
+		out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+		var r route
+		helm.UnmarshalK8SYaml(t, out, &r)
+		if r.Spec.TLS.DestinationCACertificate != "my-ca" {
+			t.Errorf("%s: destination CA should come from values. ca=%v\n", message, r.Spec.TLS.DestinationCACertificate)
+		}
+	}
+}
+
+func TestManagerRoutePassthrough(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"manager.route.externalCertificate": "manager-route-tls",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/manager-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 1 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var r route
+	helm.UnmarshalK8SYaml(t, outs[0], &r)
+	if r.Spec.TLS.Termination != "passthrough" || r.Spec.TLS.DestinationCACertificate != "" || r.Spec.TLS.ExternalCertificate != nil {
+		t.Errorf("Passthrough route should have no certificates. tls=%+v\n", r.Spec.TLS)
+	}
+}
+
+func TestControllerAPISVCRouteReencrypt(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"controller.apisvc.route.enabled":     "true",
+			"controller.apisvc.route.termination": "reencrypt",
+			"controller.certificate.key":          "my-key",
+			"controller.certificate.certificate":  "my-cert",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/controller-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 1 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var r route
+	helm.UnmarshalK8SYaml(t, outs[0], &r)
+	if r.Metadata.Name != "neuvector-route-api" {
+		t.Errorf("Incorrect route name. name=%v\n", r.Metadata.Name)
+	}
+	if strings.TrimSpace(r.Spec.TLS.DestinationCACertificate) != "my-cert" {
+		t.Errorf("Destination CA should be the controller certificate. ca=%v\n", r.Spec.TLS.DestinationCACertificate)
+	}
+}
+
+func TestFederationRouteExternalCertificate(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"controller.federation.mastersvc.route.enabled":                                               "true",
+			"controller.federation.mastersvc.route.termination":                                           "reencrypt",
+			"controller.federation.mastersvc.route.host":                                                  "fed.example.com",
+			"controller.federation.mastersvc.route.wildcardPolicy":                                        "None",
+			"controller.federation.mastersvc.route.externalCertificate":                                   "fed-master-tls",
+			"controller.federation.mastersvc.route.annotations.haproxy\\.router\\.openshift\\.io/timeout": "60s",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/controller-route.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 1 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var r route
+	helm.UnmarshalK8SYaml(t, outs[0], &r)
+	if r.Metadata.Name != "neuvector-route-fed-master" {
+		t.Errorf("Incorrect route name. name=%v\n", r.Metadata.Name)
+	}
+	if r.Metadata.Annotations["haproxy.router.openshift.io/timeout"] != "60s" {
+		t.Errorf("Incorrect route annotations. annotations=%v\n", r.Metadata.Annotations)
+	}
+	if r.Spec.WildcardPolicy != "None" {
+		t.Errorf("Incorrect wildcard policy. wildcardPolicy=%v\n", r.Spec.WildcardPolicy)
+	}
+	if r.Spec.TLS.ExternalCertificate == nil || r.Spec.TLS.ExternalCertificate.Name != "fed-master-tls" {
+		t.Errorf("Incorrect external certificate. tls=%+v\n", r.Spec.TLS)
+	}
+	if r.Spec.TLS.DestinationCACertificate == "" {
+		t.Errorf("Destination CA should be generated\n")
+	}
+
+	// Router must be able to read the external certificate
+	out = helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/route-secret-role.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs = splitYaml(out)
+
+	if len(outs) != 2 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var role rbacv1.Role
+	helm.UnmarshalK8SYaml(t, outs[0], &role)
+	if len(role.Rules) != 1 || len(role.Rules[0].ResourceNames) != 1 || role.Rules[0].ResourceNames[0] != "fed-master-tls" {
+		t.Errorf("Incorrect router role. rules=%+v\n", role.Rules)
+	}
+
+	var rb rbacv1.RoleBinding
+	helm.UnmarshalK8SYaml(t, outs[1], &rb)
+	if rb.Subjects[0].Name != "router" || rb.Subjects[0].Namespace != "openshift-ingress" {
+		t.Errorf("Incorrect router role binding. subjects=%+v\n", rb.Subjects)
+	}
+}
+
+func TestRegistryAdapterRouteReencrypt(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"cve.adapter.enabled":           "true",
+			"cve.adapter.route.termination": "reencrypt",
+		},
+	}
+
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/registry-adapter-secret.yaml", "templates/registry-adapter-ingress.yaml"}, "--api-versions", "route.openshift.io/v1")
+	outs := splitYaml(out)
+
+	if len(outs) != 2 {
+		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
+	}
+
+	var secret corev1.Secret
+	helm.UnmarshalK8SYaml(t, outs[0], &secret)
+	var r route
+	helm.UnmarshalK8SYaml(t, outs[1], &r)
+
+	pem := secret.Data["ssl-cert.pem"]
+	if r.Metadata.Name != "neuvector-route-registry-adapter" {
+		t.Errorf("Incorrect route name. name=%v\n", r.Metadata.Name)
+	}
+	if strings.TrimSpace(r.Spec.TLS.DestinationCACertificate) != strings.TrimSpace(string(pem)) {
+		t.Errorf("Destination CA doesn't match the registry adapter certificate. ca=%v\n", r.Spec.TLS.DestinationCACertificate)
+	}
 }
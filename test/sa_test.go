@@ -1,9 +1,14 @@
 package test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 )
 
 func TestServiceAccountLeastPrivilege(t *testing.T) {
@@ -16,10 +21,243 @@ func TestServiceAccountLeastPrivilege(t *testing.T) {
 	}
 
 	// Test ingress
-	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/serviceaccount-least.yaml"})
+	out := helm.RenderTemplate(t, options, helmChartPath, nvRel, []string{"templates/serviceaccount.yaml"})
 	outs := splitYaml(out)
 
 	if len(outs) != 7 {
 		t.Errorf("Resource count is wrong. count=%v\n", len(outs))
 	}
 }
+
+func TestServiceAccountWorkloadIdentity(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	cases := []struct {
+		name           string
+		values         map[string]string
+		deployment     string
+		serviceAccount string
+		annotations    map[string]string
+		podLabels      map[string]string
+		binding        string
+	}{
+		{
+			name: "aws irsa",
+			values: map[string]string{
+				"leastPrivilege": "true",
+				"cve.scanner.serviceAccount.annotations.eks\\.amazonaws\\.com/role-arn": "arn:aws:iam::123456789012:role/neuvector-scanner",
+			},
+			deployment:     "Deployment/neuvector-scanner-pod",
+			serviceAccount: "scanner",
+			annotations:    map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::123456789012:role/neuvector-scanner"},
+			binding:        "RoleBinding/neuvector-binding-secret",
+		},
+		{
+			name: "aws pod identity",
+			values: map[string]string{
+				"leastPrivilege":                  "true",
+				"cve.adapter.enabled":             "true",
+				"cve.adapter.serviceAccount.name": "neuvector-registry-adapter",
+			},
+			deployment:     "Deployment/neuvector-registry-adapter-pod",
+			serviceAccount: "neuvector-registry-adapter",
+			binding:        "RoleBinding/neuvector-binding-secret",
+		},
+		{
+			name: "azure",
+			values: map[string]string{
+				"cve.scanner.serviceAccount.name":                                              "neuvector-scanner",
+				"cve.scanner.serviceAccount.annotations.azure\\.workload\\.identity/client-id": "00000000-0000-0000-0000-000000000000",
+				"cve.scanner.serviceAccount.labels.team":                                       "security",
+			},
+			deployment:     "Deployment/neuvector-scanner-pod",
+			serviceAccount: "neuvector-scanner",
+			annotations:    map[string]string{"azure.workload.identity/client-id": "00000000-0000-0000-0000-000000000000"},
+			podLabels:      map[string]string{"azure.workload.identity/use": "true"},
+			binding:        "RoleBinding/neuvector-binding-secret",
+		},
+		{
+			name: "azure with pod labels",
+			values: map[string]string{
+				"cve.scanner.serviceAccount.name":                                              "neuvector-scanner",
+				"cve.scanner.serviceAccount.annotations.azure\\.workload\\.identity/client-id": "00000000-0000-0000-0000-000000000000",
+				"cve.scanner.podLabels.azure\\.workload\\.identity/use":                        "true",
+				"cve.scanner.podLabels.team":                                                   "security",
+			},
+			deployment:     "Deployment/neuvector-scanner-pod",
+			serviceAccount: "neuvector-scanner",
+			annotations:    map[string]string{"azure.workload.identity/client-id": "00000000-0000-0000-0000-000000000000"},
+			podLabels:      map[string]string{"azure.workload.identity/use": "true", "team": "security"},
+			binding:        "RoleBinding/neuvector-binding-secret",
+		},
+		{
+			name: "gcp",
+			values: map[string]string{
+				"leastPrivilege": "true",
+				"controller.serviceAccount.annotations.iam\\.gke\\.io/gcp-service-account": "neuvector@my-project.iam.gserviceaccount.com",
+			},
+			deployment:     "Deployment/neuvector-controller-pod",
+			serviceAccount: "controller",
+			annotations:    map[string]string{"iam.gke.io/gcp-service-account": "neuvector@my-project.iam.gserviceaccount.com"},
+			binding:        "ClusterRoleBinding/neuvector-binding-app",
+		},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: c.values,
+			Logger:    logger.Discard,
+		}
+		objs, _ := renderObjects(t, helmChartPath, options)
+
+		var sa corev1.ServiceAccount
+		doc, ok := objs["ServiceAccount/"+c.serviceAccount]
+		if !ok {
+			t.Errorf("%s: service account %s is not rendered\n", c.name, c.serviceAccount)
+			continue
+		}
+		helm.UnmarshalK8SYaml(t, doc, &sa)
+		if len(sa.Annotations) != len(c.annotations) {
+			t.Errorf("%s: service account annotations are wrong. annotations=%v\n", c.name, sa.Annotations)
+		}
+		for k, v := range c.annotations {
+			if sa.Annotations[k] != v {
+				t.Errorf("%s: service account annotation %s is wrong. annotations=%v\n", c.name, k, sa.Annotations)
+			}
+		}
+		for k, v := range c.values {
+			if label := strings.TrimPrefix(k, "cve.scanner.serviceAccount.labels."); label != k && sa.Labels[label] != v {
+				t.Errorf("%s: service account label %s is wrong. labels=%v\n", c.name, label, sa.Labels)
+			}
+		}
+
+		var dep appsv1.Deployment
+		helm.UnmarshalK8SYaml(t, objs[c.deployment], &dep)
+		if dep.Spec.Template.Spec.ServiceAccountName != c.serviceAccount {
+			t.Errorf("%s: %s service account is wrong. serviceAccount=%v\n", c.name, c.deployment, dep.Spec.Template.Spec.ServiceAccountName)
+		}
+		if _, ok := dep.Spec.Template.Labels["azure.workload.identity/use"]; ok != (c.podLabels != nil) {
+			t.Errorf("%s: %s pod labels are wrong. labels=%v\n", c.name, c.deployment, dep.Spec.Template.Labels)
+		}
+		if n := strings.Count(objs[c.deployment], "azure.workload.identity/use:"); n > 1 {
+			t.Errorf("%s: %s pod label azure.workload.identity/use is duplicated. count=%v\n", c.name, c.deployment, n)
+		}
+		for k, v := range c.podLabels {
+			if dep.Spec.Template.Labels[k] != v {
+				t.Errorf("%s: %s pod label %s is wrong. labels=%v\n", c.name, c.deployment, k, dep.Spec.Template.Labels)
+			}
+		}
+
+		// the other pods keep their account and labels
+		var ctrl appsv1.Deployment
+		helm.UnmarshalK8SYaml(t, objs["Deployment/neuvector-manager-pod"], &ctrl)
+		if _, ok := ctrl.Spec.Template.Labels["azure.workload.identity/use"]; ok {
+			t.Errorf("%s: manager pods should not be labeled for workload identity\n", c.name)
+		}
+
+		var binding rbacv1.RoleBinding
+		helm.UnmarshalK8SYaml(t, objs[c.binding], &binding)
+		found := false
+		for _, subject := range binding.Subjects {
+			if subject.Kind == "ServiceAccount" && subject.Name == c.serviceAccount {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: %s is not bound to %s. subjects=%+v\n", c.name, c.serviceAccount, c.binding, binding.Subjects)
+		}
+	}
+}
+
+func TestServiceAccountShared(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"serviceAccount": "neuvector",
+			"controller.serviceAccount.annotations.eks\\.amazonaws\\.com/role-arn": "arn:aws:iam::123456789012:role/neuvector",
+			"cve.scanner.serviceAccount.labels.team":                               "security",
+			"enforcer.serviceAccount.automountServiceAccountToken":                 "true",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+
+	var accounts []string
+	for name := range objs {
+		if strings.HasPrefix(name, "ServiceAccount/") {
+			accounts = append(accounts, name)
+		}
+	}
+	if len(accounts) != 1 {
+		t.Fatalf("Components should share one service account. accounts=%v\n", accounts)
+	}
+
+	var sa corev1.ServiceAccount
+	helm.UnmarshalK8SYaml(t, objs["ServiceAccount/neuvector"], &sa)
+	if sa.Annotations["eks.amazonaws.com/role-arn"] != "arn:aws:iam::123456789012:role/neuvector" {
+		t.Errorf("Service account annotations are wrong. annotations=%v\n", sa.Annotations)
+	}
+	if sa.Labels["team"] != "security" || sa.Labels["release"] != nvRel {
+		t.Errorf("Service account labels are wrong. labels=%v\n", sa.Labels)
+	}
+	if sa.AutomountServiceAccountToken == nil || !*sa.AutomountServiceAccountToken {
+		t.Errorf("Service account automountServiceAccountToken is wrong. automount=%v\n", sa.AutomountServiceAccountToken)
+	}
+
+	var binding rbacv1.ClusterRoleBinding
+	helm.UnmarshalK8SYaml(t, objs["ClusterRoleBinding/neuvector-binding-app"], &binding)
+	if len(binding.Subjects) != 1 || binding.Subjects[0].Name != "neuvector" {
+		t.Errorf("Binding subjects are wrong. subjects=%+v\n", binding.Subjects)
+	}
+}
+
+func TestServiceAccountNamed(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"cve.scanner.serviceAccount.name":   "neuvector-scanner",
+			"cve.scanner.serviceAccount.create": "false",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+
+	if _, ok := objs["ServiceAccount/neuvector-scanner"]; ok {
+		t.Errorf("Service account neuvector-scanner should not be created\n")
+	}
+
+	// without leastPrivilege, a named account is granted the same roles as the shared account
+	var binding rbacv1.ClusterRoleBinding
+	helm.UnmarshalK8SYaml(t, objs["ClusterRoleBinding/neuvector-binding-app"], &binding)
+	var subjects []string
+	for _, subject := range binding.Subjects {
+		subjects = append(subjects, subject.Name)
+	}
+	if strings.Join(subjects, ",") != "default,neuvector-scanner" {
+		t.Errorf("Binding subjects are wrong. subjects=%v\n", subjects)
+	}
+}
+
+func TestServiceAccountLeastPrivilegeCreate(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"leastPrivilege":                    "true",
+			"cve.updater.serviceAccount.create": "false",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options)
+
+	for _, name := range []string{"basic", "controller", "enforcer", "scanner", "registry-adapter", "cert-upgrader"} {
+		if _, ok := objs["ServiceAccount/"+name]; !ok {
+			t.Errorf("Service account %s is not rendered\n", name)
+		}
+	}
+	if _, ok := objs["ServiceAccount/updater"]; ok {
+		t.Errorf("Service account updater should not be created\n")
+	}
+
+	var binding rbacv1.RoleBinding
+	helm.UnmarshalK8SYaml(t, objs["RoleBinding/neuvector-binding-scanner"], &binding)
+	if len(binding.Subjects) != 2 || binding.Subjects[1].Name != "updater" {
+		t.Errorf("Binding subjects are wrong. subjects=%+v\n", binding.Subjects)
+	}
+}
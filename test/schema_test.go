@@ -0,0 +1,188 @@
+package test
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"sigs.k8s.io/yaml"
+)
+
+// indentOf returns the number of leading spaces of a line.
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// blockIndent returns the indentation of the keys of a values.yaml block. A block of only
+// comments, e.g. the examples under "key: {}", is indented as its first comment.
+func blockIndent(text string) int {
+	indent := -1
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "#") {
+			return indentOf(line)
+		}
+		if indent < 0 {
+			indent = indentOf(line)
+		}
+	}
+	return indent
+}
+
+// keyBlock returns the lines nested under key in a values.yaml block.
+func keyBlock(text string, key string) string {
+	indent := blockIndent(text)
+	if indent < 0 {
+		return ""
+	}
+	re := regexp.MustCompile(`^` + strings.Repeat(" ", indent) + regexp.QuoteMeta(key) + `:`)
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if !re.MatchString(line) {
+			continue
+		}
+		var block []string
+		for _, l := range lines[i+1:] {
+			trimmed := strings.TrimSpace(l)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") && indentOf(l) <= indent {
+				break
+			}
+			block = append(block, l)
+		}
+		return strings.Join(block, "\n")
+	}
+	return ""
+}
+
+// commentedKey reports if a values.yaml block documents the key in a comment at the indentation
+// of its keys, e.g. "#key: |", which is how optional keys without a default are listed.
+func commentedKey(text string, key string) bool {
+	indent := blockIndent(text)
+	if indent < 0 {
+		return false
+	}
+	return regexp.MustCompile(`(?m)^` + strings.Repeat(" ", indent) + `#\s*` + regexp.QuoteMeta(key) + `:`).MatchString(text)
+}
+
+// checkSchemaKeys walks the values and fails on keys missing from the schema. Unless
+// checking list items, it also fails on schema keys that are not in values.yaml.
+func checkSchemaKeys(t *testing.T, chart string, path string, values map[string]interface{}, schema map[string]interface{}, text string, reverse bool) {
+	props, ok := schema["properties"].(map[string]interface{})
+	if !ok {
+		// free-form object, e.g. annotations or resources
+		return
+	}
+
+	for k, v := range values {
+		sub, ok := props[k].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: %s.%s is missing from values.schema.json\n", chart, path, k)
+			continue
+		}
+		switch val := v.(type) {
+		case map[string]interface{}:
+			checkSchemaKeys(t, chart, path+"."+k, val, sub, keyBlock(text, k), reverse)
+		case []interface{}:
+			items, ok := sub["items"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for _, item := range val {
+				if m, ok := item.(map[string]interface{}); ok {
+					checkSchemaKeys(t, chart, path+"."+k+"[]", m, items, text, false)
+				}
+			}
+		}
+	}
+
+	if !reverse {
+		return
+	}
+	for k := range props {
+		if _, ok := values[k]; !ok && !commentedKey(text, k) {
+			t.Errorf("%s: %s.%s is in values.schema.json but not in values.yaml\n", chart, path, k)
+		}
+	}
+}
+
+func TestValuesSchemaKeys(t *testing.T) {
+	for _, chart := range []string{"core", "crd", "monitor"} {
+		text, err := os.ReadFile("../charts/" + chart + "/values.yaml")
+		if err != nil {
+			t.Fatalf("Failed to read values.yaml. chart=%v error=%v\n", chart, err)
+		}
+		raw, err := os.ReadFile("../charts/" + chart + "/values.schema.json")
+		if err != nil {
+			t.Fatalf("Failed to read values.schema.json. chart=%v error=%v\n", chart, err)
+		}
+
+		var values, schema map[string]interface{}
+		if err := yaml.Unmarshal(text, &values); err != nil {
+			t.Fatalf("Failed to parse values.yaml. chart=%v error=%v\n", chart, err)
+		}
+		if err := json.Unmarshal(raw, &schema); err != nil {
+			t.Fatalf("Failed to parse values.schema.json. chart=%v error=%v\n", chart, err)
+		}
+
+		checkSchemaKeys(t, chart, "", values, schema, string(text), true)
+	}
+}
+
+func TestValuesSchemaStrict(t *testing.T) {
+	cases := []struct {
+		chart  string
+		values map[string]string
+	}{
+		{"core", map[string]string{"controller.replica": "3"}},
+		{"core", map[string]string{"manager.svc.type": "Ingress"}},
+		{"core", map[string]string{"controller.apisvc.route.termination": "edge"}},
+		{"core", map[string]string{"runtimePath": "run/containerd/containerd.sock"}},
+		{"core", map[string]string{"enforcer.image.imagePullPolicy": "Sometimes"}},
+		{"crd", map[string]string{"crdwebhook.type": "Ingress"}},
+		{"monitor", map[string]string{"exporter.svc.typ": "ClusterIP"}},
+	}
+
+	for _, c := range cases {
+		options := &helm.Options{
+			SetValues: c.values,
+		}
+
+		_, err := helm.RenderTemplateE(t, options, "../charts/"+c.chart, nvRel, []string{})
+		if err == nil {
+			t.Errorf("Invalid values are accepted. chart=%v values=%v\n", c.chart, c.values)
+		}
+	}
+}
+
+func TestValuesSchemaFreeForm(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"controller.podLabels.team":                             "security",
+			"controller.ingress.annotations.example\\.com/name":     "value",
+			"controller.secret.data.sysinitcfg\\.yaml.Cluster_Name": "prod",
+			"global.systemDefaultRegistry":                          "registry.example.com",
+			"runtimePath":                                           "/run/k3s/containerd/containerd.sock",
+		},
+	}
+
+	helm.RenderTemplate(t, options, "../charts/core", nvRel, []string{})
+}
+
+func TestValuesSchemaTopLevelKeys(t *testing.T) {
+	// Unknown top-level keys, e.g. values of an umbrella chart, are accepted
+	for _, chart := range []string{"core", "crd", "monitor"} {
+		options := &helm.Options{
+			SetValues: map[string]string{
+				"umbrella.enabled": "true",
+			},
+		}
+
+		helm.RenderTemplate(t, options, "../charts/"+chart, nvRel, []string{})
+	}
+}
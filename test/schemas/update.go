@@ -0,0 +1,203 @@
+//go:build ignore
+
+// update.go regenerates the OpenAPI schemas used to validate the rendered manifests offline.
+// The Kubernetes schemas are trimmed to the kinds the charts create, and the schemas of the
+// custom resources are extracted from their CRD manifests.
+//
+//	cd test && go run schemas/update.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var kubeVersions = []string{"1.24", "1.25", "1.26", "1.27", "1.28", "1.29", "1.30", "1.31", "1.32", "1.33"}
+
+// kinds the charts create, in any group version served by the cluster.
+var kinds = map[string]bool{
+	"ConfigMap": true, "Secret": true, "Service": true, "ServiceAccount": true, "PersistentVolumeClaim": true,
+	"Deployment": true, "DaemonSet": true, "Job": true, "CronJob": true, "PodDisruptionBudget": true,
+	"Ingress": true, "Role": true, "RoleBinding": true, "ClusterRole": true, "ClusterRoleBinding": true,
+	"CustomResourceDefinition": true, "ValidatingWebhookConfiguration": true, "MutatingWebhookConfiguration": true,
+	"Lease": true, "PodSecurityPolicy": true,
+}
+
+var documentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+type crdSource struct {
+	module string
+	file   string
+}
+
+var crds = []crdSource{
+	{"github.com/openshift/api@v0.0.0-20260420151639-34e60874783e", "route/v1/zz_generated.crd-manifests/routes.crd.yaml"},
+	{"github.com/prometheus-operator/prometheus-operator@v0.85.0", "example/prometheus-operator-crd/monitoring.coreos.com_servicemonitors.yaml"},
+	{"github.com/cert-manager/cert-manager@v1.16.0", "deploy/crds/crd-certificates.yaml"},
+	{"github.com/cert-manager/cert-manager@v1.16.0", "deploy/crds/crd-issuers.yaml"},
+	{"k8s.io/autoscaler/vertical-pod-autoscaler@v1.4.0", "deploy/vpa-v1-crd-gen.yaml"},
+}
+
+func download(module string) string {
+	out, err := exec.Command("go", "mod", "download", "-json", module).Output()
+	if err != nil {
+		panic(fmt.Sprintf("failed to download %s: %v", module, err))
+	}
+	var info struct{ Dir string }
+	if err := json.Unmarshal(out, &info); err != nil {
+		panic(err)
+	}
+	return info.Dir
+}
+
+// collectRefs adds the definitions referenced by the schema.
+func collectRefs(node interface{}, refs map[string]bool, defs map[string]interface{}) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if ref, ok := v.(string); ok && k == "$ref" {
+				name := strings.TrimPrefix(ref, "#/definitions/")
+				if !refs[name] {
+					refs[name] = true
+					collectRefs(defs[name], refs, defs)
+				}
+				continue
+			}
+			collectRefs(v, refs, defs)
+		}
+	case []interface{}:
+		for _, v := range n {
+			collectRefs(v, refs, defs)
+		}
+	}
+}
+
+// stripDescriptions drops the documentation, which is most of the size of the schemas.
+// Properties named "description" are schemas, not strings, so they are kept.
+func stripDescriptions(node interface{}) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if _, ok := v.(string); ok && k == "description" {
+				delete(n, k)
+				continue
+			}
+			stripDescriptions(v)
+		}
+	case []interface{}:
+		for _, v := range n {
+			stripDescriptions(v)
+		}
+	}
+}
+
+func writeJSON(path string, v interface{}) {
+	stripDescriptions(v)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+	fmt.Println(path)
+}
+
+func updateKubernetes() {
+	for _, version := range kubeVersions {
+		dir := download("k8s.io/kubernetes@v" + version + ".0")
+		data, err := os.ReadFile(filepath.Join(dir, "api/openapi-spec/swagger.json"))
+		if err != nil {
+			panic(err)
+		}
+		var spec struct {
+			Definitions map[string]interface{} `json:"definitions"`
+		}
+		if err := json.Unmarshal(data, &spec); err != nil {
+			panic(err)
+		}
+
+		refs := make(map[string]bool)
+		for name, def := range spec.Definitions {
+			gvks, _ := def.(map[string]interface{})["x-kubernetes-group-version-kind"].([]interface{})
+			for _, gvk := range gvks {
+				if kinds[gvk.(map[string]interface{})["kind"].(string)] && !refs[name] {
+					refs[name] = true
+					collectRefs(def, refs, spec.Definitions)
+				}
+			}
+		}
+
+		names := make([]string, 0, len(refs))
+		for name := range refs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		defs := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			defs[name] = spec.Definitions[name]
+		}
+		writeJSON(filepath.Join("schemas", "kubernetes", "v"+version+".json"), map[string]interface{}{"definitions": defs})
+	}
+}
+
+func updateCRDs() {
+	for _, src := range crds {
+		data, err := os.ReadFile(filepath.Join(download(src.module), src.file))
+		if err != nil {
+			panic(err)
+		}
+		// a file can hold several definitions, e.g. the VPA and its checkpoints
+		for _, doc := range documentSeparator.Split(string(data), -1) {
+			if strings.TrimSpace(doc) == "" {
+				continue
+			}
+			var crd struct {
+				Kind string `json:"kind"`
+				Spec struct {
+					Group string `json:"group"`
+					Names struct {
+						Kind string `json:"kind"`
+					} `json:"names"`
+					Versions []struct {
+						Name   string `json:"name"`
+						Schema struct {
+							OpenAPIV3Schema interface{} `json:"openAPIV3Schema"`
+						} `json:"schema"`
+					} `json:"versions"`
+				} `json:"spec"`
+			}
+			if err := yaml.Unmarshal([]byte(doc), &crd); err != nil {
+				panic(err)
+			}
+			if crd.Kind != "CustomResourceDefinition" {
+				continue
+			}
+			for _, v := range crd.Spec.Versions {
+				name := fmt.Sprintf("%s_%s_%s.json", crd.Spec.Group, v.Name, crd.Spec.Names.Kind)
+				writeJSON(filepath.Join("schemas", "crds", name), v.Schema.OpenAPIV3Schema)
+			}
+		}
+	}
+}
+
+func main() {
+	for _, dir := range []string{"kubernetes", "crds"} {
+		if err := os.MkdirAll(filepath.Join("schemas", dir), 0755); err != nil {
+			panic(err)
+		}
+	}
+	updateKubernetes()
+	updateCRDs()
+}
@@ -0,0 +1,209 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Reviewed exceptions to the security rules. A new exception needs an entry with a reason.
+const securityExceptionsFile = "security-exceptions.yaml"
+
+type securityFinding struct {
+	scenario  string
+	rule      string
+	kind      string
+	name      string
+	container string
+	hostPath  string
+	path      string
+	message   string
+}
+
+func (f *securityFinding) String() string {
+	return fmt.Sprintf("%s: %s/%s: %s: %s: %s", f.scenario, f.kind, f.name, f.path, f.rule, f.message)
+}
+
+// securityException allows the findings of a rule on a workload. Container and hostPath narrow
+// the match, and scenarios limits it to some fixtures. Empty fields match anything.
+type securityException struct {
+	Rule      string   `json:"rule"`
+	Kind      string   `json:"kind"`
+	Name      string   `json:"name"`
+	Container string   `json:"container"`
+	HostPath  string   `json:"hostPath"`
+	Scenarios []string `json:"scenarios"`
+	Reason    string   `json:"reason"`
+
+	used bool
+}
+
+func (e *securityException) matches(f *securityFinding) bool {
+	if e.Rule != f.rule || (e.Kind != "" && e.Kind != f.kind) || (e.Name != "" && e.Name != f.name) {
+		return false
+	}
+	if e.Container != "" && e.Container != f.container {
+		return false
+	}
+	if e.HostPath != "" && e.HostPath != f.hostPath {
+		return false
+	}
+	if len(e.Scenarios) == 0 {
+		return true
+	}
+	for _, s := range e.Scenarios {
+		if s == f.scenario {
+			return true
+		}
+	}
+	return false
+}
+
+// podSpecOf returns the pod spec of a workload and its path in the object.
+func podSpecOf(t *testing.T, kind string, output string) (*corev1.PodSpec, string) {
+	switch kind {
+	case "Deployment", "DaemonSet", "StatefulSet", "Job":
+		var obj struct {
+			Spec struct {
+				Template corev1.PodTemplateSpec `json:"template"`
+			} `json:"spec"`
+		}
+		if err := yaml.Unmarshal([]byte(output), &obj); err != nil {
+			t.Fatalf("Failed to parse %v. error=%v\n", kind, err)
+		}
+		return &obj.Spec.Template.Spec, "spec.template.spec"
+	case "CronJob":
+		var obj struct {
+			Spec struct {
+				JobTemplate struct {
+					Spec struct {
+						Template corev1.PodTemplateSpec `json:"template"`
+					} `json:"spec"`
+				} `json:"jobTemplate"`
+			} `json:"spec"`
+		}
+		if err := yaml.Unmarshal([]byte(output), &obj); err != nil {
+			t.Fatalf("Failed to parse %v. error=%v\n", kind, err)
+		}
+		return &obj.Spec.JobTemplate.Spec.Template.Spec, "spec.jobTemplate.spec.template.spec"
+	}
+	return nil, ""
+}
+
+// checkSecurityRules returns the findings of a rendered workload.
+func checkSecurityRules(spec *corev1.PodSpec, base securityFinding, path string) []securityFinding {
+	var findings []securityFinding
+	add := func(rule, container, hostPath, field, message string) {
+		f := base
+		f.rule, f.container, f.hostPath, f.path, f.message = rule, container, hostPath, field, message
+		findings = append(findings, f)
+	}
+
+	if spec.HostPID {
+		add("host-namespace", "", "", path+".hostPID", "shares the host process namespace")
+	}
+	if spec.HostIPC {
+		add("host-namespace", "", "", path+".hostIPC", "shares the host IPC namespace")
+	}
+	if spec.HostNetwork {
+		add("host-namespace", "", "", path+".hostNetwork", "shares the host network namespace")
+	}
+	for i, v := range spec.Volumes {
+		if v.HostPath != nil {
+			add("host-path", "", v.HostPath.Path, fmt.Sprintf("%s.volumes[%d].hostPath", path, i), "mounts "+v.HostPath.Path+" from the host")
+		}
+	}
+
+	check := func(field string, containers []corev1.Container) {
+		for i, c := range containers {
+			cpath := fmt.Sprintf("%s.%s[%d]", path, field, i)
+			if sc := c.SecurityContext; sc != nil {
+				if sc.Privileged != nil && *sc.Privileged {
+					add("privileged", c.Name, "", cpath+".securityContext.privileged", "runs privileged")
+				}
+				if sc.Capabilities != nil && len(sc.Capabilities.Add) > 0 {
+					add("capabilities", c.Name, "", cpath+".securityContext.capabilities.add", fmt.Sprintf("adds capabilities %v", sc.Capabilities.Add))
+				}
+			}
+			limits := c.Resources.Limits
+			if _, ok := limits[corev1.ResourceCPU]; !ok {
+				add("resource-limits", c.Name, "", cpath+".resources.limits.cpu", "has no cpu limit")
+			}
+			if _, ok := limits[corev1.ResourceMemory]; !ok {
+				add("resource-limits", c.Name, "", cpath+".resources.limits.memory", "has no memory limit")
+			}
+		}
+	}
+	check("initContainers", spec.InitContainers)
+	check("containers", spec.Containers)
+	return findings
+}
+
+func TestSecurityRules(t *testing.T) {
+	data, err := os.ReadFile(securityExceptionsFile)
+	if err != nil {
+		t.Fatalf("Failed to read the security exceptions. error=%v\n", err)
+	}
+	var exceptions []*securityException
+	if err := yaml.UnmarshalStrict(data, &exceptions); err != nil {
+		t.Fatalf("Failed to parse the security exceptions. error=%v\n", err)
+	}
+	for _, e := range exceptions {
+		if e.Rule == "" || e.Reason == "" {
+			t.Errorf("Security exception needs a rule and a reason. exception=%+v\n", *e)
+		}
+		if (e.Kind == "" || e.Name == "") && len(e.Scenarios) == 0 {
+			t.Errorf("Security exception without a workload needs scenarios. exception=%+v\n", *e)
+		}
+		if e.Rule == "host-path" && e.HostPath == "" {
+			t.Errorf("Security exception of host-path needs the hostPath. exception=%+v\n", *e)
+		}
+	}
+
+	fixtures := loadFixtures(t)
+	names := make([]string, 0, len(fixtures))
+	for name := range fixtures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, chart := range snapshotCharts {
+			out := renderFixture(t, fixtures[name], chart, "")
+			for _, output := range splitYaml(out) {
+				var obj namedObject
+				if err := yaml.Unmarshal([]byte(output), &obj); err != nil {
+					t.Fatalf("Failed to parse the rendered object. error=%v\n", err)
+				}
+				spec, path := podSpecOf(t, obj.Kind, output)
+				if spec == nil {
+					continue
+				}
+
+				base := securityFinding{scenario: name, kind: obj.Kind, name: obj.Name}
+				for _, f := range checkSecurityRules(spec, base, path) {
+					allowed := false
+					for _, e := range exceptions {
+						if e.matches(&f) {
+							e.used = true
+							allowed = true
+						}
+					}
+					if !allowed {
+						t.Errorf("%v\n", f.String())
+					}
+				}
+			}
+		}
+	}
+
+	for _, e := range exceptions {
+		if !e.used {
+			t.Errorf("Security exception is not used anymore, remove it. exception=%+v\n", *e)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"sigs.k8s.io/yaml"
+)
+
+// Regenerate the golden files with: go test -run TestSnapshots -update
+var update = flag.Bool("update", false, "update the golden files of the snapshot tests")
+
+const snapshotKubeVersion = "1.33.0"
+
+var snapshotCharts = []string{"core", "crd", "monitor"}
+
+// snapshotFixture is a scenario in fixtures/*.yaml. Each chart is rendered with its own values.
+type snapshotFixture struct {
+	APIVersions []string               `json:"apiVersions"`
+	KubeVersion string                 `json:"kubeVersion"`
+	Core        map[string]interface{} `json:"core"`
+	CRD         map[string]interface{} `json:"crd"`
+	Monitor     map[string]interface{} `json:"monitor"`
+}
+
+func (f *snapshotFixture) values(chart string) map[string]interface{} {
+	switch chart {
+	case "core":
+		return f.Core
+	case "crd":
+		return f.CRD
+	default:
+		return f.Monitor
+	}
+}
+
+var (
+	snapshotPEM       = regexp.MustCompile(`-----BEGIN ([A-Z ]+)-----[\s\S]*?-----END [A-Z ]+-----`)
+	snapshotPEMBase64 = regexp.MustCompile(`(?m)^(\s*[\w.-]+: )"?LS0tLS1CRUdJTi[A-Za-z0-9+/=]*"?$`)
+	snapshotChecksum  = regexp.MustCompile(`(?m)^(\s*checksum/[\w.-]+: )[0-9a-f]{64}$`)
+	snapshotPassword  = regexp.MustCompile(`(?m)^(\s*bootstrapPassword: )\S+$`)
+)
+
+// normalizeSnapshot replaces the output that changes on every render: generated certificates,
+// random passwords and the checksums of the secrets holding them.
+func normalizeSnapshot(out string) string {
+	out = snapshotPEM.ReplaceAllString(out, "<generated $1>")
+	out = snapshotPEMBase64.ReplaceAllString(out, "${1}<generated PEM>")
+	out = snapshotChecksum.ReplaceAllString(out, "${1}<checksum>")
+	out = snapshotPassword.ReplaceAllString(out, "${1}<password>")
+	return strings.TrimSpace(out) + "\n"
+}
+
+// loadFixtures reads the scenarios in fixtures/*.yaml, keyed by file name.
+func loadFixtures(t *testing.T) map[string]*snapshotFixture {
+	paths, err := filepath.Glob("fixtures/*.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No snapshot fixtures found. error=%v\n", err)
+	}
+
+	fixtures := make(map[string]*snapshotFixture)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read fixture. file=%v error=%v\n", path, err)
+		}
+		var fixture snapshotFixture
+		if err := yaml.UnmarshalStrict(data, &fixture); err != nil {
+			t.Fatalf("Failed to parse fixture. file=%v error=%v\n", path, err)
+		}
+		fixtures[strings.TrimSuffix(filepath.Base(path), ".yaml")] = &fixture
+	}
+	return fixtures
+}
+
+// renderFixture renders a chart with the fixture values. The kube version of the fixture is
+// used if kubeVersion is empty.
+func renderFixture(t *testing.T, fixture *snapshotFixture, chart string, kubeVersion string) string {
+	values, err := yaml.Marshal(fixture.values(chart))
+	if err != nil {
+		t.Fatalf("Failed to marshal values. chart=%v error=%v\n", chart, err)
+	}
+	valuesFile := filepath.Join(t.TempDir(), chart+".yaml")
+	if err := os.WriteFile(valuesFile, values, 0644); err != nil {
+		t.Fatalf("Failed to write values. chart=%v error=%v\n", chart, err)
+	}
+
+	if kubeVersion == "" {
+		kubeVersion = fixture.KubeVersion
+	}
+	if kubeVersion == "" {
+		kubeVersion = snapshotKubeVersion
+	}
+	args := []string{"--kube-version", kubeVersion}
+	for _, api := range fixture.APIVersions {
+		args = append(args, "--api-versions", api)
+	}
+
+	options := &helm.Options{
+		ValuesFiles: []string{valuesFile},
+		Logger:      logger.Discard,
+	}
+	return helm.RenderTemplate(t, options, "../charts/"+chart, nvRel, []string{}, args...)
+}
+
+func TestSnapshots(t *testing.T) {
+	for name, fixture := range loadFixtures(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, chart := range snapshotCharts {
+				out := normalizeSnapshot(renderFixture(t, fixture, chart, ""))
+				golden := filepath.Join("fixtures", "golden", name, chart+".yaml")
+
+				if *update {
+					if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+						t.Fatalf("Failed to create golden directory. error=%v\n", err)
+					}
+					if err := os.WriteFile(golden, []byte(out), 0644); err != nil {
+						t.Fatalf("Failed to write golden file. error=%v\n", err)
+					}
+					continue
+				}
+
+				expected, err := os.ReadFile(golden)
+				if err != nil {
+					t.Errorf("Failed to read golden file, run with -update to create it. file=%v error=%v\n", golden, err)
+					continue
+				}
+				if string(expected) != out {
+					t.Errorf("Rendered manifests differ from %v, run with -update if the change is intended.\n%s", golden, diffLines(string(expected), out))
+				}
+			}
+		})
+	}
+}
+
+// diffLines returns the first lines that differ, enough to locate the change.
+func diffLines(expected, actual string) string {
+	exp := strings.Split(expected, "\n")
+	act := strings.Split(actual, "\n")
+
+	var b strings.Builder
+	count := 0
+	for i := 0; i < len(exp) || i < len(act); i++ {
+		var e, a string
+		if i < len(exp) {
+			e = exp[i]
+		}
+		if i < len(act) {
+			a = act[i]
+		}
+		if e == a {
+			continue
+		}
+		fmt.Fprintf(&b, "line %d:\n- %s\n+ %s\n", i+1, e, a)
+		if count++; count == 10 {
+			break
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,245 @@
+package test
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/files"
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// Capture the immutable fields of a chart version with:
+//
+//	git worktree add /tmp/neuvector-helm-2.4.5 <2.4.5 commit>
+//	go test -run TestUpgradeCompatibility/2.4.5 . -capture /tmp/neuvector-helm-2.4.5/charts
+var capture = flag.String("capture", "", "charts directory of an older chart version to capture the immutable fields of the upgrade fixtures with")
+
+// upgradeFixture is the values of a release installed with an older chart version, in
+// fixtures/upgrade/<chart version>/values.yaml.
+type upgradeFixture struct {
+	snapshotFixture
+	// ReuseValues is set when the values are the complete values of the release, as returned by
+	// helm get values --all. helm upgrade --reuse-values renders the new chart with them instead of
+	// the defaults of the new chart, so keys added since are missing.
+	ReuseValues bool `json:"reuseValues"`
+}
+
+// upgradeImmutable is the immutable fields of the rendering of an upgrade fixture, by chart, object
+// and field path, in fixtures/upgrade/<chart version>/immutable.yaml.
+type upgradeImmutable struct {
+	ChartVersion string                                       `json:"chartVersion"`
+	Charts       map[string]map[string]map[string]interface{} `json:"charts"`
+}
+
+// immutableFields are the fields of a kind that cannot be changed by helm upgrade, by path.
+var immutableFields = map[string][]string{
+	"Deployment":            {"spec.selector"},
+	"DaemonSet":             {"spec.selector"},
+	"StatefulSet":           {"spec.selector", "spec.serviceName", "spec.volumeClaimTemplates", "spec.podManagementPolicy"},
+	"Service":               {"spec.clusterIP"},
+	"PersistentVolumeClaim": {"spec.accessModes", "spec.storageClassName", "spec.volumeMode", "spec.volumeName", "spec.selector", "spec.dataSource", "spec.resources.requests.storage"},
+}
+
+// renderUpgradeFixture renders a chart of a charts directory with the values of an upgrade fixture.
+func renderUpgradeFixture(t *testing.T, fixture *upgradeFixture, charts string, chart string) string {
+	values, err := yaml.Marshal(fixture.values(chart))
+	if err != nil {
+		t.Fatalf("Failed to marshal values. chart=%v error=%v\n", chart, err)
+	}
+
+	path := filepath.Join(charts, chart)
+	options := &helm.Options{Logger: logger.Discard}
+	if fixture.ReuseValues {
+		dir := t.TempDir()
+		if err := files.CopyFolderContents(path, dir); err != nil {
+			t.Fatalf("Failed to copy chart. chart=%v error=%v\n", chart, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "values.yaml"), values, 0644); err != nil {
+			t.Fatalf("Failed to write values. chart=%v error=%v\n", chart, err)
+		}
+		path = dir
+	} else {
+		valuesFile := filepath.Join(t.TempDir(), chart+".yaml")
+		if err := os.WriteFile(valuesFile, values, 0644); err != nil {
+			t.Fatalf("Failed to write values. chart=%v error=%v\n", chart, err)
+		}
+		options.ValuesFiles = []string{valuesFile}
+	}
+
+	args := []string{"--kube-version", snapshotKubeVersion}
+	for _, api := range fixture.APIVersions {
+		args = append(args, "--api-versions", api)
+	}
+	out, err := helm.RenderTemplateE(t, options, path, nvRel, []string{}, args...)
+	if err != nil {
+		t.Fatalf("%s chart does not render the values. error=%v\n", chart, err)
+	}
+	return out
+}
+
+// immutableObjects returns the immutable fields of the rendered objects, by object and field path.
+// Hooks are left out, helm recreates them on every upgrade.
+func immutableObjects(t *testing.T, out string) map[string]map[string]interface{} {
+	objs := make(map[string]map[string]interface{})
+	for _, manifest := range splitYaml(out) {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(manifest), &obj); err != nil {
+			t.Fatalf("Failed to parse manifest. error=%v\n%s", err, manifest)
+		}
+		kind, _ := obj["kind"].(string)
+		paths, ok := immutableFields[kind]
+		if !ok {
+			continue
+		}
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		if annotations, _ := metadata["annotations"].(map[string]interface{}); annotations["helm.sh/hook"] != nil {
+			continue
+		}
+
+		fields := make(map[string]interface{})
+		for _, path := range paths {
+			if value, ok := fieldValue(obj, path); ok {
+				fields[path] = value
+			}
+		}
+		objs[fmt.Sprintf("%s/%s", kind, metadata["name"])] = fields
+	}
+	return objs
+}
+
+func fieldValue(obj map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = obj
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// upgradeBreaks returns the changes of the immutable fields that make helm upgrade fail, or that
+// delete an object of the old release.
+func upgradeBreaks(old, current map[string]map[string]interface{}) []string {
+	var breaks []string
+	for name, oldFields := range old {
+		fields, ok := current[name]
+		if !ok {
+			breaks = append(breaks, fmt.Sprintf("%s is not rendered anymore, helm upgrade deletes it", name))
+			continue
+		}
+		kind := strings.SplitN(name, "/", 2)[0]
+		for _, path := range immutableFields[kind] {
+			oldValue, oldOk := oldFields[path]
+			value, ok := fields[path]
+			if path == "spec.resources.requests.storage" && oldOk && ok {
+				// a volume claim can be expanded, not shrunk
+				oldSize, err1 := resource.ParseQuantity(fmt.Sprint(oldValue))
+				size, err2 := resource.ParseQuantity(fmt.Sprint(value))
+				if err1 == nil && err2 == nil && size.Cmp(oldSize) >= 0 {
+					continue
+				}
+			}
+			if oldOk != ok || !reflect.DeepEqual(oldValue, value) {
+				breaks = append(breaks, fmt.Sprintf("%s %s changed from %v to %v", name, path, printable(oldValue, oldOk), printable(value, ok)))
+			}
+		}
+	}
+	sort.Strings(breaks)
+	return breaks
+}
+
+func printable(value interface{}, ok bool) string {
+	if !ok {
+		return "<unset>"
+	}
+	out, _ := json.Marshal(value)
+	return string(out)
+}
+
+// TestUpgradeCompatibility renders the values of releases of older chart versions with the current
+// chart, and compares the fields an upgrade cannot change with the rendering of the older version.
+func TestUpgradeCompatibility(t *testing.T) {
+	paths, err := filepath.Glob("fixtures/upgrade/*/values.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No upgrade fixtures found. error=%v\n", err)
+	}
+
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read fixture. file=%v error=%v\n", path, err)
+			}
+			var fixture upgradeFixture
+			if err := yaml.UnmarshalStrict(data, &fixture); err != nil {
+				t.Fatalf("Failed to parse fixture. file=%v error=%v\n", path, err)
+			}
+
+			immutableFile := filepath.Join(dir, "immutable.yaml")
+			if *capture != "" {
+				captureImmutable(t, &fixture, *capture, immutableFile)
+				return
+			}
+
+			data, err = os.ReadFile(immutableFile)
+			if err != nil {
+				t.Fatalf("Failed to read immutable fields, run with -capture to create them. file=%v error=%v\n", immutableFile, err)
+			}
+			var old upgradeImmutable
+			if err := yaml.UnmarshalStrict(data, &old); err != nil {
+				t.Fatalf("Failed to parse immutable fields. file=%v error=%v\n", immutableFile, err)
+			}
+
+			for _, chart := range snapshotCharts {
+				current := immutableObjects(t, renderUpgradeFixture(t, &fixture, "../charts", chart))
+				for _, b := range upgradeBreaks(old.Charts[chart], current) {
+					t.Errorf("%s chart: upgrade of the chart %s rendering breaks: %s\n", chart, old.ChartVersion, b)
+				}
+			}
+		})
+	}
+}
+
+func captureImmutable(t *testing.T, fixture *upgradeFixture, charts string, file string) {
+	data, err := os.ReadFile(filepath.Join(charts, "core", "Chart.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to read chart. charts=%v error=%v\n", charts, err)
+	}
+	var chart struct {
+		Version string `json:"version"`
+	}
+	if err := yaml.Unmarshal(data, &chart); err != nil {
+		t.Fatalf("Failed to parse chart. charts=%v error=%v\n", charts, err)
+	}
+
+	immutable := upgradeImmutable{
+		ChartVersion: chart.Version,
+		Charts:       make(map[string]map[string]map[string]interface{}),
+	}
+	for _, name := range snapshotCharts {
+		immutable.Charts[name] = immutableObjects(t, renderUpgradeFixture(t, fixture, charts, name))
+	}
+	out, err := yaml.Marshal(immutable)
+	if err != nil {
+		t.Fatalf("Failed to marshal immutable fields. error=%v\n", err)
+	}
+	header := fmt.Sprintf("# Immutable fields of the rendering of values.yaml by chart %s, captured with -capture.\n", chart.Version)
+	if err := os.WriteFile(file, append([]byte(header), out...), 0644); err != nil {
+		t.Fatalf("Failed to write immutable fields. error=%v\n", err)
+	}
+}
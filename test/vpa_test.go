@@ -0,0 +1,268 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"helm.sh/helm/v3/pkg/strvals"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+var vpaValues = map[string]string{
+	"controller.vpa.enabled":  "true",
+	"enforcer.vpa.enabled":    "true",
+	"manager.vpa.enabled":     "true",
+	"cve.scanner.vpa.enabled": "true",
+	"cve.adapter.vpa.enabled": "true",
+	"cve.adapter.enabled":     "true",
+}
+
+// vpaTargets returns the targets of the rendered VerticalPodAutoscalers, keyed by name.
+func vpaTargets(t *testing.T, out map[string]string) map[string]string {
+	targets := make(map[string]string)
+	for name, manifest := range out {
+		if !strings.HasSuffix(name, "vpa.yaml") {
+			continue
+		}
+		for _, doc := range splitYaml(manifest) {
+			var vpa unstructured.Unstructured
+			if err := yaml.Unmarshal([]byte(doc), &vpa.Object); err != nil {
+				t.Fatalf("Failed to parse the VerticalPodAutoscaler. error=%v\n", err)
+			}
+			kind, _, _ := unstructured.NestedString(vpa.Object, "spec", "targetRef", "kind")
+			target, _, _ := unstructured.NestedString(vpa.Object, "spec", "targetRef", "name")
+			targets[vpa.GetName()] = kind + "/" + target
+		}
+	}
+	return targets
+}
+
+func TestVPACapability(t *testing.T) {
+	helmChartPath := "../charts/core"
+
+	options := &helm.Options{
+		SetValues: vpaValues,
+		Logger:    logger.Discard,
+	}
+	objs, _ := renderObjects(t, helmChartPath, options)
+	for name := range objs {
+		if strings.HasPrefix(name, "VerticalPodAutoscaler/") {
+			t.Errorf("%s should not be rendered without autoscaling.k8s.io/v1\n", name)
+		}
+	}
+
+	objs, _ = renderObjects(t, helmChartPath, options, "--api-versions", "autoscaling.k8s.io/v1")
+	for name, target := range map[string]string{
+		"neuvector-controller-vpa":       "Deployment/neuvector-controller-pod",
+		"neuvector-enforcer-vpa":         "DaemonSet/neuvector-enforcer-pod",
+		"neuvector-manager-vpa":          "Deployment/neuvector-manager-pod",
+		"neuvector-scanner-vpa":          "Deployment/neuvector-scanner-pod",
+		"neuvector-registry-adapter-vpa": "Deployment/neuvector-registry-adapter-pod",
+	} {
+		doc, ok := objs["VerticalPodAutoscaler/"+name]
+		if !ok {
+			t.Errorf("VerticalPodAutoscaler/%s is not rendered\n", name)
+			continue
+		}
+		var vpa unstructured.Unstructured
+		helm.UnmarshalK8SYaml(t, doc, &vpa.Object)
+		kind, _, _ := unstructured.NestedString(vpa.Object, "spec", "targetRef", "kind")
+		ref, _, _ := unstructured.NestedString(vpa.Object, "spec", "targetRef", "name")
+		if kind+"/"+ref != target {
+			t.Errorf("%s: target is wrong. target=%v/%v\n", name, kind, ref)
+		}
+		if _, ok := objs[target]; !ok {
+			t.Errorf("%s: target %s is not rendered\n", name, target)
+		}
+	}
+
+	// the workloads that are disabled, or whose VPA is disabled, have none
+	options = &helm.Options{
+		SetValues: mergeValues(vpaValues, map[string]string{
+			"manager.enabled":         "false",
+			"cve.adapter.enabled":     "false",
+			"enforcer.vpa.enabled":    "false",
+			"cve.scanner.vpa.enabled": "false",
+		}),
+		Logger: logger.Discard,
+	}
+	objs, _ = renderObjects(t, helmChartPath, options, "--api-versions", "autoscaling.k8s.io/v1")
+	var names []string
+	for name := range objs {
+		if strings.HasPrefix(name, "VerticalPodAutoscaler/") {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 1 || names[0] != "VerticalPodAutoscaler/neuvector-controller-vpa" {
+		t.Errorf("Unexpected VerticalPodAutoscalers. names=%v\n", names)
+	}
+}
+
+func TestVPASpec(t *testing.T) {
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"controller.vpa.enabled":             "true",
+			"controller.vpa.minReplicas":         "2",
+			"controller.vpa.controlledValues":    "RequestsOnly",
+			"controller.vpa.controlledResources": "{memory}",
+			"controller.vpa.minAllowed.memory":   "1Gi",
+			"controller.vpa.maxAllowed.cpu":      "2",
+			"controller.vpa.maxAllowed.memory":   "4Gi",
+			"enforcer.vpa.enabled":               "true",
+			"fullnameOverride":                   "nv",
+		},
+		SetStrValues: map[string]string{
+			"enforcer.vpa.updateMode": "Off",
+		},
+		Logger: logger.Discard,
+	}
+	objs, _ := renderObjects(t, "../charts/core", options, "--api-versions", "autoscaling.k8s.io/v1")
+
+	expected := map[string]string{
+		"VerticalPodAutoscaler/nv-controller-vpa": `
+apiVersion: autoscaling.k8s.io/v1
+kind: VerticalPodAutoscaler
+spec:
+  targetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: nv-controller-pod
+  updatePolicy:
+    updateMode: Auto
+    minReplicas: 2
+  resourcePolicy:
+    containerPolicies:
+      - containerName: neuvector-controller-pod
+        controlledResources: [memory]
+        controlledValues: RequestsOnly
+        minAllowed:
+          memory: 1Gi
+        maxAllowed:
+          cpu: 2
+          memory: 4Gi
+`,
+		"VerticalPodAutoscaler/nv-enforcer-vpa": `
+apiVersion: autoscaling.k8s.io/v1
+kind: VerticalPodAutoscaler
+spec:
+  targetRef:
+    apiVersion: apps/v1
+    kind: DaemonSet
+    name: nv-enforcer-pod
+  updatePolicy:
+    updateMode: "Off"
+  resourcePolicy:
+    containerPolicies:
+      - containerName: neuvector-enforcer-pod
+        controlledResources: [cpu, memory]
+`,
+	}
+	for name, manifest := range expected {
+		var actual, want map[string]interface{}
+		helm.UnmarshalK8SYaml(t, objs[name], &actual)
+		helm.UnmarshalK8SYaml(t, manifest, &want)
+		delete(actual, "metadata")
+		a, _ := yaml.Marshal(actual)
+		w, _ := yaml.Marshal(want)
+		if string(a) != string(w) {
+			t.Errorf("%s is wrong.\n%s", name, a)
+		}
+	}
+}
+
+func TestVPAScannerAutoscale(t *testing.T) {
+	cases := map[string]map[string]string{
+		"initcfg": {
+			"controller.initcfg.sys.Scanner_Autoscale.Strategy": "delayed",
+		},
+		"secret": {
+			"controller.secret.enabled": "true",
+			"controller.secret.data.sysinitcfg\\.yaml.Scanner_Autoscale.Strategy": "immediate",
+		},
+		"configmap": {
+			"controller.configmap.enabled":                "true",
+			"controller.configmap.data.sysinitcfg\\.yaml": "Scanner_Autoscale:\n  Strategy: immediate\n",
+		},
+	}
+
+	for name, values := range cases {
+		options := &helm.Options{
+			SetValues: mergeValues(vpaValues, values),
+			Logger:    logger.Discard,
+		}
+		objs, _ := renderObjects(t, "../charts/core", options, "--api-versions", "autoscaling.k8s.io/v1")
+		if _, ok := objs["VerticalPodAutoscaler/neuvector-scanner-vpa"]; ok {
+			t.Errorf("%s: the scanner autoscaled by the controller should not have a VerticalPodAutoscaler\n", name)
+		}
+		if _, ok := objs["VerticalPodAutoscaler/neuvector-controller-vpa"]; !ok {
+			t.Errorf("%s: the controller VerticalPodAutoscaler is not rendered\n", name)
+		}
+	}
+}
+
+func TestVPAHorizontalPodAutoscaler(t *testing.T) {
+	hpa := func(namespace string, kind string, name string) runtime.Object {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "autoscaling/v2", Kind: "HorizontalPodAutoscaler"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: kind, Name: name},
+				MaxReplicas:    5,
+			},
+		}
+	}
+	values := make(map[string]interface{})
+	for k, v := range vpaValues {
+		if err := strvals.ParseInto(k+"="+v, values); err != nil {
+			t.Fatalf("Failed to parse value. key=%v error=%v\n", k, err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		objects  []runtime.Object
+		expected []string
+	}{
+		{
+			name:     "no hpa",
+			expected: []string{"controller", "enforcer", "manager", "registry-adapter", "scanner"},
+		},
+		{
+			name: "scanner and manager hpa",
+			objects: []runtime.Object{
+				hpa("neuvector", "Deployment", "neuvector-scanner-pod"),
+				hpa("neuvector", "Deployment", "neuvector-manager-pod"),
+			},
+			expected: []string{"controller", "enforcer", "registry-adapter"},
+		},
+		{
+			name: "hpa of another namespace",
+			objects: []runtime.Object{
+				hpa("other", "Deployment", "neuvector-scanner-pod"),
+			},
+			expected: []string{"controller", "enforcer", "manager", "registry-adapter", "scanner"},
+		},
+	}
+
+	for _, c := range cases {
+		out, err := renderValuesWithCluster(t, "core", values, []string{"autoscaling.k8s.io/v1"}, c.objects...)
+		if err != nil {
+			t.Fatalf("%s: failed to render chart. error=%v\n", c.name, err)
+		}
+		targets := vpaTargets(t, out)
+		if len(targets) != len(c.expected) {
+			t.Errorf("%s: unexpected VerticalPodAutoscalers. targets=%v\n", c.name, targets)
+		}
+		for _, component := range c.expected {
+			if _, ok := targets["neuvector-"+component+"-vpa"]; !ok {
+				t.Errorf("%s: the %s VerticalPodAutoscaler is not rendered. targets=%v\n", c.name, component, targets)
+			}
+		}
+	}
+}